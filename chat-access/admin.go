@@ -0,0 +1,190 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	jwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	// Type of the claims admins sign for each request.
+	adminClaimType = "chat-admin"
+	// Users we issue carry their role as a tag, e.g. "role:moderator".
+	roleTagPrefix = "role:"
+)
+
+// adminAuth proves who is making an admin request. Claim is a JWT signed
+// by the admin's nkey with the request subject as sub, the user acted on
+// as name, if any, and a recent iat. Admins that are not configured with
+// -admin-keys also send a user JWT we issued with an admin role.
+//
+// A claim can be replayed for as long as maxNonceSkew, but only for the
+// same subject and user, which is harmless for revoking and listing.
+type adminAuth struct {
+	Claim string `json:"claim"`
+	JWT   string `json:"jwt,omitempty"`
+}
+
+// provisionedRequest is sent to chat.req.provisioned by admins.
+type provisionedRequest struct {
+	requestHeader
+	Auth *adminAuth `json:"auth,omitempty"`
+}
+
+// provisionedResponse maps usernames to their public keys.
+type provisionedResponse struct {
+	responseHeader
+	Users map[string]string `json:"users,omitempty"`
+}
+
+// Admins can provision users with any configured role. Admission
+// checks are left out, the admin is trusted with the name.
+func (as *accessService) handleProvision(m *nats.Msg) {
+	var req provisionRequest
+	if aerr := decodeRequest(m.Data, &req); aerr != nil {
+		respondJSON(m, &accessResponse{responseHeader: newResponseHeader(&req.requestHeader, aerr)})
+		return
+	}
+	reqName := simpleName([]byte(req.Name))
+	actor, err := as.authorizeAdmin(req.Auth, provisionSubj, reqName)
+	if err != nil {
+		log.Printf("Rejected provisioning of %q: %v\n", reqName, err)
+		respondJSON(m, &accessResponse{
+			responseHeader: newResponseHeader(&req.requestHeader, toAPIError(err)),
+			Name:           reqName,
+		})
+		return
+	}
+	lifetime := time.Duration(req.Lifetime) * time.Second
+	ic, err := as.generateUserCreds(reqName, req.Role, false, lifetime)
+	if err != nil {
+		respondJSON(m, &accessResponse{
+			responseHeader: newResponseHeader(&req.requestHeader, toAPIError(err)),
+			Name:           reqName,
+		})
+		return
+	}
+	log.Printf("Provisioned %q as %q for %q\n", reqName, ic.role, actor)
+	respondJSON(m, &accessResponse{
+		responseHeader: newResponseHeader(&req.requestHeader, nil),
+		Name:           reqName,
+		Role:           ic.role,
+		Creds:          ic.creds,
+		PublicKey:      ic.pub,
+		Expires:        ic.expires,
+	})
+	as.auditProvision(reqName, actor, req.Reason, ic, as.requestSource(m))
+	as.publishProvisioned()
+}
+
+// authorizeAdmin checks auth is a fresh admin claim for subject and
+// target and returns who the admin is, for the audit trail.
+func (as *accessService) authorizeAdmin(auth *adminAuth, subject, target string) (string, error) {
+	if auth == nil || auth.Claim == "" {
+		return "", errUnauthenticated
+	}
+	gc, err := jwt.DecodeGeneric(auth.Claim)
+	if err != nil {
+		return "", errBadSignature
+	}
+	if t, _ := gc.Data["type"].(string); t != adminClaimType {
+		return "", errUnauthenticated
+	}
+	if gc.Subject != subject || gc.Name != target {
+		return "", errUnauthenticated
+	}
+	now := time.Now()
+	if d := now.Sub(time.Unix(gc.IssuedAt, 0)); d > maxNonceSkew || d < -maxNonceSkew {
+		return "", errStaleNonce
+	}
+	if gc.Expires > 0 && gc.Expires < now.Unix() {
+		return "", errExpired
+	}
+
+	// Configured admin keys are trusted as they are.
+	if as.adminKeys[gc.Issuer] {
+		return gc.Issuer, nil
+	}
+	if auth.JWT == "" {
+		return "", errNotAdmin
+	}
+
+	// Otherwise the key has to belong to one of our users with an admin role.
+	uc, err := jwt.DecodeUserClaims(auth.JWT)
+	if err != nil {
+		return "", errBadRequest
+	}
+	if uc.Subject != gc.Issuer || !as.issuedByUs(uc) {
+		return "", errNotAdmin
+	}
+	if uc.Expires > 0 && uc.Expires < now.Unix() {
+		return "", errExpired
+	}
+	r := as.roles.Roles[roleOf(uc)]
+	if r == nil || !r.Admin {
+		return "", errNotAdmin
+	}
+	u, err := as.reg.Get(uc.Name)
+	if err != nil {
+		return "", err
+	}
+	if u == nil || u.PublicKey != uc.Subject {
+		return "", errNotAdmin
+	}
+	if u.Revoked {
+		return "", errRevoked
+	}
+	return u.Name, nil
+}
+
+// issuedByUs checks the user JWT was signed by our account.
+func (as *accessService) issuedByUs(uc *jwt.UserClaims) bool {
+	if uc.IssuerAccount != as.acc.Subject && uc.Issuer != as.acc.Subject {
+		return false
+	}
+	return uc.Issuer == as.acc.Subject || as.acc.SigningKeys.Contains(uc.Issuer)
+}
+
+// roleOf returns the role we tagged the user JWT with.
+func roleOf(uc *jwt.UserClaims) string {
+	for _, t := range uc.Tags {
+		if strings.HasPrefix(t, roleTagPrefix) {
+			return strings.TrimPrefix(t, roleTagPrefix)
+		}
+	}
+	return ""
+}
+
+// parseAdminKeys reads the comma separated -admin-keys.
+func parseAdminKeys(keys string) (map[string]bool, error) {
+	m := make(map[string]bool)
+	for _, k := range strings.Split(keys, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		if !nkeys.IsValidPublicUserKey(k) {
+			return nil, fmt.Errorf("admin key %q is not a user public key", k)
+		}
+		m[k] = true
+	}
+	return m, nil
+}
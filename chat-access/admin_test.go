@@ -0,0 +1,169 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/connecteverything/oscon2019/creds"
+	jwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+// adminClaim is what admin tools sign to use subject on target.
+func adminClaim(t *testing.T, kp nkeys.KeyPair, subject, target string, expires time.Time) string {
+	t.Helper()
+	gc := jwt.NewGenericClaims(subject)
+	gc.Name = target
+	gc.Data["type"] = adminClaimType
+	if !expires.IsZero() {
+		gc.Expires = expires.Unix()
+	}
+	claim, err := gc.Encode(kp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claim
+}
+
+// staleClaim is an admin claim issued at the given time, which Encode
+// does not allow.
+func staleClaim(t *testing.T, kp nkeys.KeyPair, subject, target string, at time.Time) string {
+	t.Helper()
+	pub, _ := kp.PublicKey()
+	gc := jwt.NewGenericClaims(subject)
+	gc.Name, gc.Issuer, gc.IssuedAt = target, pub, at.Unix()
+	gc.Data["type"] = adminClaimType
+	enc := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(&jwt.Header{Type: jwt.TokenTypeJwt, Algorithm: jwt.AlgorithmNkey})
+	payload, err := json.Marshal(gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toSign := enc(header) + "." + enc(payload)
+	sig, err := kp.Sign([]byte(toSign))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return toSign + "." + enc(sig)
+}
+
+// issueAs provisions name with the given role and returns its creds.
+func issueAs(t *testing.T, as *accessService, name, role string) *creds.Creds {
+	t.Helper()
+	ic, err := as.generateUserCreds(name, role, false, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := creds.Parse([]byte(ic.creds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Wipe)
+	return c
+}
+
+func TestAuthorizeAdmin(t *testing.T) {
+	rc, err := loadRoles("roles.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := newTestService(t, rc)
+	admin := issueAs(t, as, "root", "admin")
+	member := issueAs(t, as, "alice", "member")
+	gone := issueAs(t, as, "gone", "admin")
+	as.reg.Update("gone", func(u *userRecord) error {
+		u.Revoked = true
+		return nil
+	})
+
+	keyAdmin, _ := nkeys.CreateUser()
+	keyPub, _ := keyAdmin.PublicKey()
+	as.adminKeys[keyPub] = true
+
+	// An admin JWT signed by someone else.
+	other := newTestService(t, rc)
+	foreign := issueAs(t, other, "root", "admin")
+
+	const subj, target = provisionSubj, "bob"
+	now := time.Now()
+	tests := []struct {
+		name  string
+		auth  *adminAuth
+		actor string
+		err   error
+	}{
+		{"admin key", &adminAuth{Claim: adminClaim(t, keyAdmin, subj, target, time.Time{})}, keyPub, nil},
+		{"admin user", &adminAuth{Claim: adminClaim(t, admin.KeyPair, subj, target, time.Time{}), JWT: admin.JWT}, "root", nil},
+		{"no auth", nil, "", errUnauthenticated},
+		{"no claim", &adminAuth{JWT: admin.JWT}, "", errUnauthenticated},
+		{"bad claim", &adminAuth{Claim: "not.a.claim"}, "", errBadSignature},
+		{"wrong subject", &adminAuth{Claim: adminClaim(t, keyAdmin, provSubj, target, time.Time{})}, "", errUnauthenticated},
+		{"wrong target", &adminAuth{Claim: adminClaim(t, keyAdmin, subj, "carol", time.Time{})}, "", errUnauthenticated},
+		{"stale", &adminAuth{Claim: staleClaim(t, keyAdmin, subj, target, now.Add(-2*maxNonceSkew))}, "", errStaleNonce},
+		{"future", &adminAuth{Claim: staleClaim(t, keyAdmin, subj, target, now.Add(2*maxNonceSkew))}, "", errStaleNonce},
+		{"expired", &adminAuth{Claim: adminClaim(t, keyAdmin, subj, target, now.Add(-time.Second))}, "", errExpired},
+		{"user without jwt", &adminAuth{Claim: adminClaim(t, admin.KeyPair, subj, target, time.Time{})}, "", errNotAdmin},
+		{"bad jwt", &adminAuth{Claim: adminClaim(t, admin.KeyPair, subj, target, time.Time{}), JWT: "bad"}, "", errBadRequest},
+		{"jwt of someone else", &adminAuth{Claim: adminClaim(t, member.KeyPair, subj, target, time.Time{}), JWT: admin.JWT}, "", errNotAdmin},
+		{"not an admin role", &adminAuth{Claim: adminClaim(t, member.KeyPair, subj, target, time.Time{}), JWT: member.JWT}, "", errNotAdmin},
+		{"not issued by us", &adminAuth{Claim: adminClaim(t, foreign.KeyPair, subj, target, time.Time{}), JWT: foreign.JWT}, "", errNotAdmin},
+		{"revoked", &adminAuth{Claim: adminClaim(t, gone.KeyPair, subj, target, time.Time{}), JWT: gone.JWT}, "", errRevoked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actor, err := as.authorizeAdmin(tt.auth, subj, target)
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if actor != tt.actor {
+				t.Fatalf("got actor %q, want %q", actor, tt.actor)
+			}
+		})
+	}
+}
+
+func TestIssuedByUs(t *testing.T) {
+	as := newTestService(t, defaultRoles())
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	skp, _ := nkeys.CreateAccount()
+	spub, _ := skp.PublicKey()
+	as.acc = jwt.NewAccountClaims(apub)
+	as.acc.SigningKeys.Add(spub)
+	otherSK, _ := nkeys.CreateAccount()
+	otherPub, _ := otherSK.PublicKey()
+
+	tests := []struct {
+		name          string
+		issuer        string
+		issuerAccount string
+		want          bool
+	}{
+		{"account", apub, "", true},
+		{"signing key", spub, apub, true},
+		{"signing key without account", spub, "", false},
+		{"other key", otherPub, apub, false},
+		{"other account", otherPub, otherPub, false},
+	}
+	for _, tt := range tests {
+		uc := jwt.NewUserClaims("UABC")
+		uc.Issuer, uc.IssuerAccount = tt.issuer, tt.issuerAccount
+		if got := as.issuedByUs(uc); got != tt.want {
+			t.Errorf("%s: issuedByUs = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// admissionRequest is what each admission check gets to look at
+// before we sign any credentials. It is also what we send to an
+// external approver.
+type admissionRequest struct {
+	Name   string      `json:"name"`
+	Role   string      `json:"role,omitempty"`
+	Client *clientInfo `json:"client,omitempty"`
+	// Source identifies the requestor, the client IP as forwarded in
+	// the request headers, when we run behind a proxy we trust.
+	Source string `json:"source,omitempty"`
+}
+
+// admissionResponse is what an external approver replies with.
+type admissionResponse struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// admissionCheck returns an error if the request should be rejected.
+type admissionCheck func(ar *admissionRequest) error
+
+// Headers we look at, in order, to find out who is asking. Clients can
+// set them to anything, so they are only used with -trust-proxy, when
+// a proxy in front of NATS sets them for every request.
+var sourceHeaders = []string{"X-Forwarded-For", "X-Real-Ip", "Client-Ip"}
+
+// requestSource returns the first address found in the headers, if any.
+func (as *accessService) requestSource(m *nats.Msg) string {
+	if !as.trustProxy || m.Header == nil {
+		return ""
+	}
+	for _, h := range sourceHeaders {
+		if v := m.Header.Get(h); v != "" {
+			return strings.TrimSpace(strings.Split(v, ",")[0])
+		}
+	}
+	return ""
+}
+
+func notAdmitted(format string, args ...interface{}) error {
+	return &apiError{statusForbidden, "NOT_ADMITTED", fmt.Sprintf(format, args...), "Not admitted"}
+}
+
+// admit runs all checks in order, the first to fail rejects the request.
+func admit(checks []admissionCheck, ar *admissionRequest) error {
+	for _, check := range checks {
+		if err := check(ar); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nameCheck rejects names not matching allow, or matching deny.
+// Either can be nil.
+func nameCheck(allow, deny *regexp.Regexp) admissionCheck {
+	return func(ar *admissionRequest) error {
+		if allow != nil && !allow.MatchString(ar.Name) {
+			return notAdmitted("name %q is not allowed", ar.Name)
+		}
+		if deny != nil && deny.MatchString(ar.Name) {
+			return notAdmitted("name %q is not allowed", ar.Name)
+		}
+		return nil
+	}
+}
+
+// reservedCheck rejects names we keep for ourselves.
+func reservedCheck(reserved []string) admissionCheck {
+	rs := make(map[string]struct{}, len(reserved))
+	for _, r := range reserved {
+		rs[simpleName([]byte(r))] = struct{}{}
+	}
+	return func(ar *admissionRequest) error {
+		if _, ok := rs[ar.Name]; ok {
+			return notAdmitted("name %q is reserved", ar.Name)
+		}
+		return nil
+	}
+}
+
+// How often userCounter counts the registry again.
+const userRecount = time.Minute
+
+// userCounter keeps count of the active users, so we do not list the
+// registry on every request. Other replicas provision and revoke users
+// too, so it is counted again every userRecount.
+type userCounter struct {
+	sync.Mutex
+	reg     registry
+	active  int
+	counted time.Time
+}
+
+func (uc *userCounter) count() (int, error) {
+	uc.Lock()
+	defer uc.Unlock()
+	if time.Since(uc.counted) < userRecount {
+		return uc.active, nil
+	}
+	users, err := uc.reg.List()
+	if err != nil {
+		return 0, err
+	}
+	active := 0
+	for _, u := range users {
+		if !u.Revoked {
+			active++
+		}
+	}
+	uc.active, uc.counted = active, time.Now()
+	return active, nil
+}
+
+// add follows the users we provision, and revoke with -1.
+func (uc *userCounter) add(n int) {
+	uc.Lock()
+	uc.active += n
+	uc.Unlock()
+}
+
+// maxUsersCheck rejects requests once we have max active users.
+func maxUsersCheck(users *userCounter, max int) admissionCheck {
+	return func(ar *admissionRequest) error {
+		active, err := users.count()
+		if err != nil {
+			return err
+		}
+		if active >= max {
+			return notAdmitted("maximum number of users reached")
+		}
+		return nil
+	}
+}
+
+// rateLimiter allows a number of requests per source in a window.
+// Requests without a source all share the same budget, which is all
+// of them unless we trust a proxy to tell us the source.
+type rateLimiter struct {
+	sync.Mutex
+	max    int
+	window time.Duration
+	seen   map[string][]time.Time
+}
+
+func newRateLimiter(max int, window time.Duration) *rateLimiter {
+	return &rateLimiter{max: max, window: window, seen: make(map[string][]time.Time)}
+}
+
+func (rl *rateLimiter) check(ar *admissionRequest) error {
+	rl.Lock()
+	defer rl.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-rl.window)
+
+	// Forget anything outside of the window.
+	for src, times := range rl.seen {
+		i := 0
+		for i < len(times) && times[i].Before(cutoff) {
+			i++
+		}
+		if i == len(times) {
+			delete(rl.seen, src)
+		} else {
+			rl.seen[src] = times[i:]
+		}
+	}
+
+	if len(rl.seen[ar.Source]) >= rl.max {
+		return errRateLimited
+	}
+	rl.seen[ar.Source] = append(rl.seen[ar.Source], now)
+	return nil
+}
+
+// approverCheck asks an external service over NATS to accept or reject
+// each request. No answer in time is a rejection. Why it failed is only
+// logged, the approver's reason for rejecting is passed on.
+func approverCheck(nc *nats.Conn, subject string, timeout time.Duration) admissionCheck {
+	return func(ar *admissionRequest) error {
+		data, err := json.Marshal(ar)
+		if err != nil {
+			return err
+		}
+		resp, err := nc.Request(subject, data, timeout)
+		if err != nil {
+			log.Printf("Error asking approver about %q: %v", ar.Name, err)
+			return notAdmitted("approval failed")
+		}
+		var ad admissionResponse
+		if err := json.Unmarshal(resp.Data, &ad); err != nil {
+			log.Printf("Error decoding approval of %q: %v", ar.Name, err)
+			return notAdmitted("approval failed")
+		}
+		if !ad.Allowed {
+			if ad.Reason == "" {
+				ad.Reason = "rejected by approver"
+			}
+			return notAdmitted("%s", ad.Reason)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestNameCheck(t *testing.T) {
+	allow := regexp.MustCompile("^[a-z]+$")
+	deny := regexp.MustCompile("admin")
+	tests := []struct {
+		name        string
+		allow, deny *regexp.Regexp
+		ok          bool
+	}{
+		{"alice", nil, nil, true},
+		{"alice", allow, nil, true},
+		{"alice2", allow, nil, false},
+		{"alice", nil, deny, true},
+		{"sysadmin", nil, deny, false},
+		{"sysadmin", allow, deny, false},
+		{"bob", allow, deny, true},
+	}
+	for _, tt := range tests {
+		err := nameCheck(tt.allow, tt.deny)(&admissionRequest{Name: tt.name})
+		if (err == nil) != tt.ok {
+			t.Errorf("nameCheck(%v, %v) on %q = %v", tt.allow, tt.deny, tt.name, err)
+		}
+	}
+}
+
+func TestReservedCheck(t *testing.T) {
+	// Reserved names are compared as requested names end up.
+	check := reservedCheck([]string{"admin", "Support Team", "moderators"})
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"alice", true},
+		{"admin", false},
+		{"support", false},
+		{"moderato", false},
+		{"moderators", true},
+		{"admins", true},
+	}
+	for _, tt := range tests {
+		if err := check(&admissionRequest{Name: tt.name}); (err == nil) != tt.ok {
+			t.Errorf("reservedCheck on %q = %v", tt.name, err)
+		}
+	}
+}
+
+func TestSimpleName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"alice", "alice"},
+		{"Alice", "alice"},
+		{"Alice Smith", "alice"},
+		{"Bartholomew", "bartholo"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := simpleName([]byte(tt.name)); got != tt.want {
+			t.Errorf("simpleName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(2, time.Minute)
+	tests := []struct {
+		source string
+		err    error
+	}{
+		{"10.0.0.1", nil},
+		{"10.0.0.1", nil},
+		{"10.0.0.1", errRateLimited},
+		{"10.0.0.2", nil},
+		{"", nil},
+		{"", nil},
+		{"", errRateLimited},
+		{"10.0.0.2", nil},
+		{"10.0.0.2", errRateLimited},
+	}
+	for i, tt := range tests {
+		if err := rl.check(&admissionRequest{Name: "alice", Source: tt.source}); err != tt.err {
+			t.Fatalf("%d: request from %q got error %v, want %v", i, tt.source, err, tt.err)
+		}
+	}
+
+	// Requests outside of the window are forgotten.
+	rl.Lock()
+	for src, times := range rl.seen {
+		for i := range times {
+			times[i] = times[i].Add(-2 * time.Minute)
+		}
+		rl.seen[src] = times
+	}
+	rl.Unlock()
+	if err := rl.check(&admissionRequest{Name: "alice", Source: "10.0.0.1"}); err != nil {
+		t.Fatalf("request after the window got error %v", err)
+	}
+	rl.Lock()
+	defer rl.Unlock()
+	if len(rl.seen) != 1 {
+		t.Fatalf("sources outside of the window are kept: %v", rl.seen)
+	}
+}
+
+func TestMaxUsersCheck(t *testing.T) {
+	as := newTestService(t, defaultRoles())
+	as.reg.Create(&userRecord{Name: "alice", PublicKey: "UA"})
+	as.reg.Create(&userRecord{Name: "bob", PublicKey: "UB", Revoked: true})
+
+	tests := []struct {
+		name string
+		max  int
+		ok   bool
+	}{
+		{"room", 2, true},
+		{"revoked do not count", 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users := &userCounter{reg: as.reg}
+			if err := maxUsersCheck(users, tt.max)(&admissionRequest{Name: "carol"}); (err == nil) != tt.ok {
+				t.Fatalf("got error %v", err)
+			}
+		})
+	}
+
+	// Between counts we follow what we provision and revoke.
+	users := &userCounter{reg: as.reg}
+	check := maxUsersCheck(users, 2)
+	if err := check(&admissionRequest{Name: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	users.add(1)
+	if err := check(&admissionRequest{Name: "dave"}); err == nil {
+		t.Fatal("admitted over the maximum")
+	}
+	users.add(-1)
+	if err := check(&admissionRequest{Name: "dave"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	calls := 0
+	pass := func(*admissionRequest) error { calls++; return nil }
+	fail := func(*admissionRequest) error { calls++; return errRateLimited }
+	tests := []struct {
+		name   string
+		checks []admissionCheck
+		err    error
+		calls  int
+	}{
+		{"none", nil, nil, 0},
+		{"all pass", []admissionCheck{pass, pass}, nil, 2},
+		{"first fails", []admissionCheck{fail, pass}, errRateLimited, 1},
+		{"last fails", []admissionCheck{pass, fail}, errRateLimited, 2},
+	}
+	for _, tt := range tests {
+		calls = 0
+		if err := admit(tt.checks, &admissionRequest{Name: "alice"}); err != tt.err || calls != tt.calls {
+			t.Errorf("%s: got %v after %d checks, want %v after %d", tt.name, err, calls, tt.err, tt.calls)
+		}
+	}
+}
+
+func TestSetupAdmission(t *testing.T) {
+	tests := []struct {
+		name                  string
+		allow, deny, reserved string
+		rate, max             int
+		checks                int
+		ok                    bool
+	}{
+		{"none", "", "", "", 0, 0, 0, true},
+		{"all", "^[a-z]+$", "admin", "root", 10, 100, 4, true},
+		{"names", "^[a-z]+$", "admin", "", 0, 0, 1, true},
+		{"bad allow", "(", "", "", 0, 0, 0, false},
+		{"bad deny", "", "[", "", 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		checks, err := setupAdmission(tt.allow, tt.deny, tt.reserved, tt.rate, tt.max, nil)
+		if (err == nil) != tt.ok || len(checks) != tt.checks {
+			t.Errorf("%s: got %d checks, %v", tt.name, len(checks), err)
+		}
+	}
+}
+
+func TestRequestSource(t *testing.T) {
+	header := func(kv ...string) nats.Header {
+		h := nats.Header{}
+		for i := 0; i < len(kv); i += 2 {
+			h.Set(kv[i], kv[i+1])
+		}
+		return h
+	}
+	tests := []struct {
+		name   string
+		trust  bool
+		header nats.Header
+		want   string
+	}{
+		{"untrusted", false, header("X-Forwarded-For", "10.0.0.1"), ""},
+		{"no headers", true, nil, ""},
+		{"forwarded", true, header("X-Forwarded-For", "10.0.0.1, 10.0.0.2"), "10.0.0.1"},
+		{"real ip", true, header("X-Real-Ip", " 10.0.0.3 "), "10.0.0.3"},
+		{"forwarded first", true, header("Client-Ip", "10.0.0.4", "X-Forwarded-For", "10.0.0.1"), "10.0.0.1"},
+		{"other headers", true, header("Host", "chat"), ""},
+	}
+	for _, tt := range tests {
+		as := &accessService{trustProxy: tt.trust}
+		if got := as.requestSource(&nats.Msg{Header: tt.header}); got != tt.want {
+			t.Errorf("%s: got source %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	jwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	// Every audit record is published here, signed by our account.
+	auditSubj = "chat.audit.events"
+	// Query the audit trail.
+	auditQuerySubj = "chat.req.audit"
+
+	// Default and maximum number of records in a query response.
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+
+	// Actor for what we do on our own.
+	auditActor = "chat-access"
+
+	// Type of the claims audit records are published as.
+	auditClaimType = "chat-audit"
+)
+
+// Audited actions.
+const (
+	actionProvision = "provision"
+	actionRenew     = "renew"
+	actionRevoke    = "revoke"
+	actionPrune     = "prune"
+)
+
+// auditRecord is a single provisioning or revocation event.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	User      string    `json:"user"`
+	PublicKey string    `json:"nkey,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Expires   time.Time `json:"exp,omitempty"`
+	// Actor is who asked for it, the user itself for self service
+	// and chat-access for housekeeping.
+	Actor    string `json:"actor,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Source   string `json:"source,omitempty"`
+	ServerID string `json:"sid,omitempty"`
+}
+
+// auditQuery selects records, empty fields match anything.
+type auditQuery struct {
+	requestHeader
+	Auth   *adminAuth `json:"auth,omitempty"`
+	User   string     `json:"user,omitempty"`
+	Actor  string     `json:"actor,omitempty"`
+	Action string     `json:"action,omitempty"`
+	Since  time.Time  `json:"since,omitempty"`
+	Until  time.Time  `json:"until,omitempty"`
+	// Limit caps the response to the most recent matching records.
+	Limit int `json:"limit,omitempty"`
+}
+
+type auditResponse struct {
+	responseHeader
+	Records []*auditRecord `json:"records"`
+}
+
+func (q *auditQuery) match(r *auditRecord) bool {
+	if q.User != "" && q.User != r.User {
+		return false
+	}
+	if q.Actor != "" && q.Actor != r.Actor {
+		return false
+	}
+	if q.Action != "" && q.Action != r.Action {
+		return false
+	}
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && r.Time.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// limit keeps the most recent records the query asked for.
+func (q *auditQuery) limit(records []*auditRecord) []*auditRecord {
+	n := q.Limit
+	if n <= 0 {
+		n = auditDefaultLimit
+	}
+	if n > auditMaxLimit {
+		n = auditMaxLimit
+	}
+	if len(records) > n {
+		records = records[len(records)-n:]
+	}
+	return records
+}
+
+// auditSigner signs the records we publish with our account signing
+// key, and checks those we read back from auditSubj were signed by our
+// account, since anyone able to publish there could add records.
+type auditSigner struct {
+	sk  nkeys.KeyPair
+	acc *jwt.AccountClaims
+}
+
+func (s *auditSigner) sign(r *auditRecord) ([]byte, error) {
+	claim := jwt.NewGenericClaims(s.acc.Subject)
+	claim.Data["type"] = auditClaimType
+	claim.Data["record"] = r
+	cjwt, err := claim.Encode(s.sk)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(cjwt), nil
+}
+
+func (s *auditSigner) open(data []byte) (*auditRecord, error) {
+	gc, err := jwt.DecodeGeneric(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if t, _ := gc.Data["type"].(string); t != auditClaimType || gc.Subject != s.acc.Subject {
+		return nil, errors.New("not an audit record")
+	}
+	if gc.Issuer != s.acc.Subject && !s.acc.SigningKeys.Contains(gc.Issuer) {
+		return nil, errors.New("not signed by our account")
+	}
+	raw, err := json.Marshal(gc.Data["record"])
+	if err != nil {
+		return nil, err
+	}
+	var r auditRecord
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// auditLog keeps the audit trail and publishes new records on auditSubj.
+type auditLog interface {
+	// Append stores and publishes r.
+	Append(r *auditRecord) error
+	// Query returns the matching records, oldest first.
+	Query(q *auditQuery) ([]*auditRecord, error)
+	// Close releases any underlying resources.
+	Close() error
+}
+
+// openAuditLog follows the registry store, a file next to the registry
+// file, or a JetStream stream on auditSubj that replicas can share.
+func openAuditLog(kind, file, stream string, replicas int, nc *nats.Conn, signer *auditSigner) (auditLog, error) {
+	switch kind {
+	case fileStore:
+		return openFileAudit(file, nc, signer)
+	case kvStore:
+		return openStreamAudit(nc, stream, replicas, signer)
+	default:
+		return nil, fmt.Errorf("unknown audit store %q", kind)
+	}
+}
+
+// fileAudit is an append-only log of JSON records, one per line.
+type fileAudit struct {
+	sync.Mutex
+	nc      *nats.Conn
+	signer  *auditSigner
+	f       *os.File
+	records []*auditRecord
+}
+
+func openFileAudit(name string, nc *nats.Conn, signer *auditSigner) (*fileAudit, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a := &fileAudit{nc: nc, signer: signer, f: f}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var r auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+		a.records = append(a.records, &r)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *fileAudit) Append(r *auditRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	signed, err := a.signer.sign(r)
+	if err != nil {
+		return err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if _, err := a.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := a.f.Sync(); err != nil {
+		return err
+	}
+	cr := *r
+	a.records = append(a.records, &cr)
+	return a.nc.Publish(auditSubj, signed)
+}
+
+func (a *fileAudit) Query(q *auditQuery) ([]*auditRecord, error) {
+	a.Lock()
+	defer a.Unlock()
+	var records []*auditRecord
+	for _, r := range a.records {
+		if q.match(r) {
+			cr := *r
+			records = append(records, &cr)
+		}
+	}
+	return q.limit(records), nil
+}
+
+func (a *fileAudit) Close() error {
+	return a.f.Close()
+}
+
+// streamAudit keeps the audit trail in a JetStream stream that captures
+// auditSubj, so records published by any replica end up in it. Records
+// that were not signed by our account are skipped.
+type streamAudit struct {
+	js     nats.JetStreamContext
+	stream string
+	signer *auditSigner
+}
+
+func openStreamAudit(nc *nats.Conn, stream string, replicas int, signer *auditSigner) (*streamAudit, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	_, err = js.StreamInfo(stream)
+	if err == nats.ErrStreamNotFound {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:        stream,
+			Description: "KubeCon Chat provisioning audit trail",
+			Subjects:    []string{auditSubj},
+			Storage:     nats.FileStorage,
+			Replicas:    replicas,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &streamAudit{js: js, stream: stream, signer: signer}, nil
+}
+
+func (a *streamAudit) Append(r *auditRecord) error {
+	data, err := a.signer.sign(r)
+	if err != nil {
+		return err
+	}
+	_, err = a.js.Publish(auditSubj, data)
+	return err
+}
+
+// Query replays the stream from the start of the range with an
+// ordered consumer, which is fine for an occasional admin query.
+func (a *streamAudit) Query(q *auditQuery) ([]*auditRecord, error) {
+	si, err := a.js.StreamInfo(a.stream)
+	if err != nil {
+		return nil, err
+	}
+	if si.State.Msgs == 0 {
+		return nil, nil
+	}
+
+	opts := []nats.SubOpt{nats.BindStream(a.stream), nats.OrderedConsumer()}
+	if q.Since.IsZero() {
+		opts = append(opts, nats.DeliverAll())
+	} else {
+		opts = append(opts, nats.StartTime(q.Since))
+	}
+	sub, err := a.js.SubscribeSync(auditSubj, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	var records []*auditRecord
+	for {
+		m, err := sub.NextMsg(2 * time.Second)
+		if err == nats.ErrTimeout {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		meta, err := m.Metadata()
+		if err != nil {
+			return nil, err
+		}
+		if !q.Until.IsZero() && meta.Timestamp.After(q.Until) {
+			break
+		}
+		r, err := a.signer.open(m.Data)
+		if err != nil {
+			log.Printf("Skipping bad audit record %d: %v", meta.Sequence.Stream, err)
+		} else if q.match(r) {
+			records = append(records, r)
+		}
+		if meta.NumPending == 0 {
+			break
+		}
+	}
+	return q.limit(records), nil
+}
+
+func (a *streamAudit) Close() error {
+	return nil
+}
+
+// audit records an event, failures are logged but never fail the
+// operation that was audited.
+func (as *accessService) audit(r *auditRecord) {
+	r.Time = time.Now().UTC()
+	r.ServerID = as.sid
+	if err := as.auditLog.Append(r); err != nil {
+		log.Printf("Error recording audit %s of %q: %v", r.Action, r.User, err)
+	}
+}
+
+// Query the audit trail.
+func (as *accessService) handleAuditQuery(m *nats.Msg) {
+	var q auditQuery
+	if aerr := decodeRequest(m.Data, &q); aerr != nil {
+		respondJSON(m, &auditResponse{responseHeader: newResponseHeader(&q.requestHeader, aerr)})
+		return
+	}
+	if _, err := as.authorizeAdmin(q.Auth, auditQuerySubj, ""); err != nil {
+		respondJSON(m, &auditResponse{responseHeader: newResponseHeader(&q.requestHeader, toAPIError(err))})
+		return
+	}
+	records, err := as.auditLog.Query(&q)
+	if err != nil {
+		respondJSON(m, &auditResponse{responseHeader: newResponseHeader(&q.requestHeader, toAPIError(err))})
+		return
+	}
+	if records == nil {
+		records = []*auditRecord{}
+	}
+	respondJSON(m, &auditResponse{
+		responseHeader: newResponseHeader(&q.requestHeader, nil),
+		Records:        records,
+	})
+}
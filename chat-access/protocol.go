@@ -0,0 +1,236 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// protocolVersion is the version of the JSON envelope we speak.
+// Requests that are not JSON are treated as the legacy text protocol,
+// where the payload is the raw name and errors are "-ERR 'reason'".
+const protocolVersion = 1
+
+// clientInfo is optional information a client can share about itself.
+type clientInfo struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	Lang    string `json:"lang,omitempty"`
+}
+
+// requestHeader is common to all JSON requests.
+type requestHeader struct {
+	Version int    `json:"version"`
+	ID      string `json:"id,omitempty"`
+}
+
+func (h *requestHeader) header() *requestHeader {
+	return h
+}
+
+// responseHeader is common to all JSON responses.
+type responseHeader struct {
+	Version     int    `json:"version"`
+	ID          string `json:"id,omitempty"`
+	Status      int    `json:"status"`
+	Error       string `json:"error,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// newResponseHeader echoes the request id and fills in err, if any.
+func newResponseHeader(req *requestHeader, err *apiError) responseHeader {
+	rh := responseHeader{Version: protocolVersion, ID: req.ID, Status: statusOK}
+	if err != nil {
+		rh.Status = err.Status
+		rh.Error = err.Code
+		rh.Description = err.Description
+	}
+	return rh
+}
+
+// accessRequest is sent to chat.req.access.
+type accessRequest struct {
+	requestHeader
+	Name string `json:"name"`
+	// Role defaults to the configured default role.
+	Role string `json:"role,omitempty"`
+	// Lifetime is the requested lifetime of the credentials in seconds.
+	Lifetime int64       `json:"lifetime,omitempty"`
+	Client   *clientInfo `json:"client,omitempty"`
+}
+
+// accessResponse is the reply to an accessRequest.
+type accessResponse struct {
+	responseHeader
+	Name      string `json:"name,omitempty"`
+	Role      string `json:"role,omitempty"`
+	Creds     string `json:"creds,omitempty"`
+	PublicKey string `json:"nkey,omitempty"`
+	Expires   int64  `json:"exp,omitempty"`
+}
+
+// provisionRequest is sent to chat.req.provision by admins, to issue
+// credentials with roles that can not be requested, e.g. a moderator
+// or admin role. It is answered with an accessResponse.
+type provisionRequest struct {
+	requestHeader
+	Name     string     `json:"name"`
+	Role     string     `json:"role,omitempty"`
+	Lifetime int64      `json:"lifetime,omitempty"`
+	Auth     *adminAuth `json:"auth,omitempty"`
+	// Reason is recorded in the audit trail.
+	Reason string `json:"reason,omitempty"`
+}
+
+// revokeRequest is sent to chat.req.revoke.
+type revokeRequest struct {
+	requestHeader
+	Name string     `json:"name"`
+	Auth *adminAuth `json:"auth,omitempty"`
+	// Reason is recorded in the audit trail.
+	Reason string `json:"reason,omitempty"`
+}
+
+// revokeResponse is the reply to a revokeRequest.
+type revokeResponse struct {
+	responseHeader
+	Name      string `json:"name,omitempty"`
+	PublicKey string `json:"nkey,omitempty"`
+}
+
+// renewRequest is sent to chat.req.renew by a user that wants a new
+// JWT for its existing nkey. Nonce is "<unix-time>.<random>" and Sig
+// is the base64url encoded signature of the nonce by the user's nkey.
+// We look the user up by name, the JWT is only sent by older clients
+// and does not fit the payload limit of most roles.
+type renewRequest struct {
+	requestHeader
+	Name  string `json:"name,omitempty"`
+	NKey  string `json:"nkey,omitempty"`
+	JWT   string `json:"jwt,omitempty"`
+	Nonce string `json:"nonce"`
+	Sig   string `json:"sig"`
+}
+
+// renewResponse carries the new user JWT. The user keeps its seed.
+type renewResponse struct {
+	responseHeader
+	JWT     string `json:"jwt,omitempty"`
+	Expires int64  `json:"exp,omitempty"`
+}
+
+// Status codes follow their HTTP counterparts.
+const (
+	statusOK         = 200
+	statusBadRequest = 400
+	statusAuth       = 401
+	statusForbidden  = 403
+	statusNotFound   = 404
+	statusConflict   = 409
+	statusTooMany    = 429
+	statusInternal   = 500
+)
+
+// apiError is returned by our handlers and is rendered either as a
+// JSON response or as a legacy "-ERR" line.
+type apiError struct {
+	Status      int
+	Code        string
+	Description string
+	// legacy is what the text protocol has always replied with.
+	legacy string
+}
+
+func (e *apiError) Error() string {
+	return e.Description
+}
+
+func (e *apiError) legacyResponse() []byte {
+	return []byte(fmt.Sprintf("-ERR '%s'", e.legacy))
+}
+
+var (
+	errBadRequest      = &apiError{statusBadRequest, "BAD_REQUEST", "malformed request", "Bad request"}
+	errBadVersion      = &apiError{statusBadRequest, "UNSUPPORTED_VERSION", "unsupported protocol version", "Bad request"}
+	errEmptyName       = &apiError{statusBadRequest, "NAME_EMPTY", "name can not be empty", "Name can not be empty"}
+	errBadName         = &apiError{statusBadRequest, "NAME_INVALID", "name can not contain '.', '*', '>' or spaces", "Invalid name"}
+	errNameTaken       = &apiError{statusConflict, "NAME_TAKEN", "name is already taken", "API_ERROR"}
+	errUnknownRole     = &apiError{statusBadRequest, "UNKNOWN_ROLE", "role is not known", "Unknown role"}
+	errRoleNotAllowed  = &apiError{statusForbidden, "ROLE_NOT_ALLOWED", "role can not be requested", "Role not allowed"}
+	errRateLimited     = &apiError{statusTooMany, "RATE_LIMITED", "too many requests", "Too many requests"}
+	errBadSignature    = &apiError{statusAuth, "BAD_SIGNATURE", "request signature is not valid", "Bad signature"}
+	errStaleNonce      = &apiError{statusAuth, "STALE_NONCE", "nonce is too old", "Stale nonce"}
+	errExpired         = &apiError{statusAuth, "EXPIRED", "credentials have expired", "Expired"}
+	errRevoked         = &apiError{statusForbidden, "REVOKED", "user has been revoked", "Revoked"}
+	errUnknownUser     = &apiError{statusNotFound, "UNKNOWN_USER", "user is not known", "Unknown user"}
+	errUnauthenticated = &apiError{statusAuth, "UNAUTHENTICATED", "admin claim is missing or not valid", "Unauthenticated"}
+	errNotAdmin        = &apiError{statusForbidden, "NOT_ADMIN", "not an admin", "Not an admin"}
+	errNotSigningKey   = &apiError{statusForbidden, "NOT_SIGNING_KEY", "not signed by an account signing key", "Not a signing key"}
+	errInternal        = &apiError{statusInternal, "INTERNAL_ERROR", "internal error", "Internal Error"}
+)
+
+// toAPIError makes sure we never leak internal errors to clients.
+func toAPIError(err error) *apiError {
+	if ae, ok := err.(*apiError); ok {
+		return ae
+	}
+	log.Printf("Error: %v", err)
+	return errInternal
+}
+
+// isJSONRequest tells us which protocol the client is speaking.
+func isJSONRequest(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+// decodeRequest will unmarshal a JSON request and check its version.
+func decodeRequest(data []byte, v interface{ header() *requestHeader }) *apiError {
+	if err := json.Unmarshal(data, v); err != nil {
+		return errBadRequest
+	}
+	if v.header().Version != protocolVersion {
+		return errBadVersion
+	}
+	return nil
+}
+
+// requestJSON sends req as JSON and decodes the response into resp.
+func requestJSON(nc *nats.Conn, subject string, req, resp interface{}, timeout time.Duration) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	m, err := nc.Request(subject, data, timeout)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(m.Data, resp)
+}
+
+// respondJSON sends v back to the requestor.
+func respondJSON(m *nats.Msg, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		m.Respond(errInternal.legacyResponse())
+		return
+	}
+	m.Respond(data)
+}
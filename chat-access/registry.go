@@ -0,0 +1,375 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// userRecord is what we remember about each user we have seen.
+type userRecord struct {
+	Name      string    `json:"name"`
+	PublicKey string    `json:"nkey"`
+	Role      string    `json:"role,omitempty"`
+	IssuedAt  time.Time `json:"iat,omitempty"`
+	Expires   time.Time `json:"exp,omitempty"`
+	ServerID  string    `json:"sid,omitempty"`
+	Revoked   bool      `json:"revoked,omitempty"`
+	RevokedAt time.Time `json:"revoked_at,omitempty"`
+	// Pruned is set once the revocation is dropped after expiry.
+	Pruned bool `json:"pruned,omitempty"`
+	// JWT is the last user JWT we issued, which shows a delegated
+	// signer that the user has expired.
+	JWT string `json:"jwt,omitempty"`
+}
+
+// registry keeps track of provisioned users so that we survive restarts.
+type registry interface {
+	// Get returns the record for name, or nil if we do not know it.
+	Get(name string) (*userRecord, error)
+	// Create will add u only if there is no record for u.Name yet,
+	// otherwise it returns errUserExists. This is what reserves names.
+	Create(u *userRecord) error
+	// Update applies fn to the record for name and stores it, unless
+	// fn fails. It is retried from the latest record when someone else
+	// changed it in the meantime, so fn may be called more than once.
+	// It returns the stored record, or nil if we do not know name.
+	Update(name string, fn func(u *userRecord) error) (*userRecord, error)
+	// List returns all records sorted by name.
+	List() ([]*userRecord, error)
+	// Close releases any underlying resources.
+	Close() error
+}
+
+var (
+	errUserExists     = errors.New("user already exists")
+	errUpdateConflict = errors.New("user record kept changing")
+)
+
+// How many times Update tries before giving up on a busy record.
+const maxUpdateTries = 10
+
+const (
+	fileStore = "file"
+	kvStore   = "kv"
+)
+
+// openRegistry will open the registry store selected by kind.
+// Replicas only applies to the kv store.
+func openRegistry(kind, file, bucket string, replicas int, nc *nats.Conn) (registry, error) {
+	switch kind {
+	case fileStore:
+		return openFileRegistry(file)
+	case kvStore:
+		return openKVRegistry(nc, bucket, replicas)
+	default:
+		return nil, fmt.Errorf("unknown registry store %q", kind)
+	}
+}
+
+// provisioned returns the legacy view of the registry, a map of
+// usernames to public keys for all users that have not been revoked.
+func provisioned(r registry) (map[string]string, error) {
+	users, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(users))
+	for _, u := range users {
+		if !u.Revoked {
+			m[u.Name] = u.PublicKey
+		}
+	}
+	return m, nil
+}
+
+func sortRecords(users []*userRecord) []*userRecord {
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	return users
+}
+
+// fileRegistry is an append-only log of JSON records, one per line.
+// The last record for a given name wins when the log is replayed.
+type fileRegistry struct {
+	sync.Mutex
+	f     *os.File
+	users map[string]*userRecord
+}
+
+func openFileRegistry(name string) (*fileRegistry, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := &fileRegistry{f: f, users: make(map[string]*userRecord)}
+
+	// Replay the log.
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var u userRecord
+		if err := json.Unmarshal(scanner.Bytes(), &u); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+		r.users[u.Name] = &u
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *fileRegistry) Get(name string) (*userRecord, error) {
+	r.Lock()
+	defer r.Unlock()
+	if u := r.users[name]; u != nil {
+		cu := *u
+		return &cu, nil
+	}
+	return nil, nil
+}
+
+func (r *fileRegistry) Create(u *userRecord) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.users[u.Name] != nil {
+		return errUserExists
+	}
+	return r.put(u)
+}
+
+// Update holds the lock throughout, nobody else writes the file.
+func (r *fileRegistry) Update(name string, fn func(u *userRecord) error) (*userRecord, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.users[name] == nil {
+		return nil, nil
+	}
+	u := *r.users[name]
+	if err := fn(&u); err != nil {
+		return nil, err
+	}
+	if err := r.put(&u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Lock should be held.
+func (r *fileRegistry) put(u *userRecord) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if _, err := r.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := r.f.Sync(); err != nil {
+		return err
+	}
+	cu := *u
+	r.users[u.Name] = &cu
+	return nil
+}
+
+func (r *fileRegistry) List() ([]*userRecord, error) {
+	r.Lock()
+	defer r.Unlock()
+	users := make([]*userRecord, 0, len(r.users))
+	for _, u := range r.users {
+		cu := *u
+		users = append(users, &cu)
+	}
+	return sortRecords(users), nil
+}
+
+func (r *fileRegistry) Close() error {
+	return r.f.Close()
+}
+
+// kvRegistry stores one record per user in a NATS KeyValue bucket.
+// It can be shared by any number of chat-access replicas, which also
+// keep their leases in it.
+type kvRegistry struct {
+	kv nats.KeyValue
+}
+
+func openKVRegistry(nc *nats.Conn, bucket string, replicas int) (*kvRegistry, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.KeyValue(bucket)
+	if err == nats.ErrBucketNotFound {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      bucket,
+			Description: "KubeCon Chat provisioned users",
+			Storage:     nats.FileStorage,
+			Replicas:    replicas,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &kvRegistry{kv: kv}, nil
+}
+
+// Leases are kept apart from users, whose keys are never dotted.
+const leaseKeyPrefix = "lease."
+
+type leaseRecord struct {
+	Holder  string    `json:"holder"`
+	Renewed time.Time `json:"renewed"`
+}
+
+// acquire takes or renews the named lease for holder, unless another
+// holder renewed it within ttl. Coordinated replicas use it to elect
+// the one doing housekeeping.
+func (r *kvRegistry) acquire(name, holder string, ttl time.Duration) bool {
+	key := leaseKeyPrefix + name
+	data, err := json.Marshal(&leaseRecord{Holder: holder, Renewed: time.Now().UTC()})
+	if err != nil {
+		return false
+	}
+	e, err := r.kv.Get(key)
+	if err == nats.ErrKeyNotFound || err == nats.ErrKeyDeleted {
+		_, err = r.kv.Create(key, data)
+		return err == nil
+	}
+	if err != nil {
+		return false
+	}
+	var held leaseRecord
+	if err := json.Unmarshal(e.Value(), &held); err == nil && held.Holder != holder && time.Since(held.Renewed) < ttl {
+		return false
+	}
+	_, err = r.kv.Update(key, data, e.Revision())
+	return err == nil
+}
+
+// Usernames can hold characters that are not valid in keys.
+func kvKey(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+func (r *kvRegistry) Get(name string) (*userRecord, error) {
+	e, err := r.kv.Get(kvKey(name))
+	if err == nats.ErrKeyNotFound || err == nats.ErrKeyDeleted {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var u userRecord
+	if err := json.Unmarshal(e.Value(), &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (r *kvRegistry) Create(u *userRecord) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if _, err = r.kv.Create(kvKey(u.Name), data); err == nil {
+		return nil
+	}
+	// The server only tells us the expected revision did not match,
+	// so check if someone else got here first.
+	if eu, gerr := r.Get(u.Name); gerr == nil && eu != nil {
+		return errUserExists
+	}
+	return err
+}
+
+// Update only stores the record if it is still at the revision we read.
+func (r *kvRegistry) Update(name string, fn func(u *userRecord) error) (*userRecord, error) {
+	key := kvKey(name)
+	for i := 0; i < maxUpdateTries; i++ {
+		e, err := r.kv.Get(key)
+		if err == nats.ErrKeyNotFound || err == nats.ErrKeyDeleted {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var u userRecord
+		if err := json.Unmarshal(e.Value(), &u); err != nil {
+			return nil, err
+		}
+		if err := fn(&u); err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(&u)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = r.kv.Update(key, data, e.Revision()); err == nil {
+			return &u, nil
+		}
+		// As with Create, check if someone else changed it first.
+		if le, gerr := r.kv.Get(key); gerr != nil || le.Revision() == e.Revision() {
+			return nil, err
+		}
+	}
+	return nil, errUpdateConflict
+}
+
+func (r *kvRegistry) List() ([]*userRecord, error) {
+	keys, err := r.kv.Keys()
+	if err == nats.ErrNoKeysFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	users := make([]*userRecord, 0, len(keys))
+	for _, k := range keys {
+		if strings.HasPrefix(k, leaseKeyPrefix) {
+			continue
+		}
+		e, err := r.kv.Get(k)
+		if err == nats.ErrKeyNotFound || err == nats.ErrKeyDeleted {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var u userRecord
+		if err := json.Unmarshal(e.Value(), &u); err != nil {
+			return nil, err
+		}
+		users = append(users, &u)
+	}
+	return sortRecords(users), nil
+}
+
+func (r *kvRegistry) Close() error {
+	return nil
+}
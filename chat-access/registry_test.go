@@ -0,0 +1,431 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// memKV is a KeyValue bucket in memory, which checks revisions on
+// Create and Update like the server does.
+type memKV struct {
+	sync.Mutex
+	rev     uint64
+	entries map[string]*memEntry
+	// beforeUpdate is called ahead of each Update, to race with it.
+	beforeUpdate func(key string)
+}
+
+type memEntry struct {
+	key   string
+	value []byte
+	rev   uint64
+}
+
+func (e *memEntry) Bucket() string             { return "test" }
+func (e *memEntry) Key() string                { return e.key }
+func (e *memEntry) Value() []byte              { return e.value }
+func (e *memEntry) Revision() uint64           { return e.rev }
+func (e *memEntry) Created() time.Time         { return time.Time{} }
+func (e *memEntry) Delta() uint64              { return 0 }
+func (e *memEntry) Operation() nats.KeyValueOp { return nats.KeyValuePut }
+
+var errWrongLastSequence = errors.New("nats: wrong last sequence")
+
+func newMemKV() *memKV {
+	return &memKV{entries: make(map[string]*memEntry)}
+}
+
+func (kv *memKV) Get(key string) (nats.KeyValueEntry, error) {
+	kv.Lock()
+	defer kv.Unlock()
+	if e := kv.entries[key]; e != nil {
+		return e, nil
+	}
+	return nil, nats.ErrKeyNotFound
+}
+
+// Lock should be held.
+func (kv *memKV) put(key string, value []byte) uint64 {
+	kv.rev++
+	kv.entries[key] = &memEntry{key, append([]byte(nil), value...), kv.rev}
+	return kv.rev
+}
+
+func (kv *memKV) Put(key string, value []byte) (uint64, error) {
+	kv.Lock()
+	defer kv.Unlock()
+	return kv.put(key, value), nil
+}
+
+func (kv *memKV) PutString(key string, value string) (uint64, error) {
+	return kv.Put(key, []byte(value))
+}
+
+func (kv *memKV) Create(key string, value []byte) (uint64, error) {
+	return kv.Update(key, value, 0)
+}
+
+func (kv *memKV) Update(key string, value []byte, last uint64) (uint64, error) {
+	if kv.beforeUpdate != nil {
+		kv.beforeUpdate(key)
+	}
+	kv.Lock()
+	defer kv.Unlock()
+	var rev uint64
+	if e := kv.entries[key]; e != nil {
+		rev = e.rev
+	}
+	if rev != last {
+		return 0, errWrongLastSequence
+	}
+	return kv.put(key, value), nil
+}
+
+func (kv *memKV) Delete(key string) error {
+	kv.Lock()
+	defer kv.Unlock()
+	delete(kv.entries, key)
+	return nil
+}
+
+func (kv *memKV) Purge(key string) error {
+	return kv.Delete(key)
+}
+
+func (kv *memKV) Keys(opts ...nats.WatchOpt) ([]string, error) {
+	kv.Lock()
+	defer kv.Unlock()
+	if len(kv.entries) == 0 {
+		return nil, nats.ErrNoKeysFound
+	}
+	var keys []string
+	for k := range kv.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (kv *memKV) Watch(keys string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	return nil, errors.New("not supported")
+}
+
+func (kv *memKV) WatchAll(opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	return nil, errors.New("not supported")
+}
+
+func (kv *memKV) History(key string, opts ...nats.WatchOpt) ([]nats.KeyValueEntry, error) {
+	return nil, errors.New("not supported")
+}
+
+func (kv *memKV) Bucket() string {
+	return "test"
+}
+
+func (kv *memKV) PurgeDeletes(opts ...nats.WatchOpt) error {
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	stores := []struct {
+		name string
+		open func(t *testing.T) registry
+	}{
+		{fileStore, func(t *testing.T) registry {
+			r, err := openFileRegistry(filepath.Join(tempDir(t), "users.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { r.Close() })
+			return r
+		}},
+		{kvStore, func(t *testing.T) registry {
+			return &kvRegistry{kv: newMemKV()}
+		}},
+	}
+	tests := []struct {
+		name string
+		run  func(t *testing.T, r registry)
+	}{
+		{"create and get", func(t *testing.T, r registry) {
+			if err := r.Create(&userRecord{Name: "alice", PublicKey: "UA", Role: "member"}); err != nil {
+				t.Fatal(err)
+			}
+			u, err := r.Get("alice")
+			if err != nil || u == nil || u.PublicKey != "UA" || u.Role != "member" {
+				t.Fatalf("got %+v, %v", u, err)
+			}
+		}},
+		{"name taken", func(t *testing.T, r registry) {
+			r.Create(&userRecord{Name: "alice", PublicKey: "UA"})
+			if err := r.Create(&userRecord{Name: "alice", PublicKey: "UB"}); err != errUserExists {
+				t.Fatalf("got error %v, want %v", err, errUserExists)
+			}
+			if u, _ := r.Get("alice"); u.PublicKey != "UA" {
+				t.Fatalf("second create replaced the record: %+v", u)
+			}
+		}},
+		{"unknown", func(t *testing.T, r registry) {
+			if u, err := r.Get("bob"); u != nil || err != nil {
+				t.Fatalf("Get = %+v, %v", u, err)
+			}
+			called := false
+			u, err := r.Update("bob", func(u *userRecord) error {
+				called = true
+				return nil
+			})
+			if u != nil || err != nil || called {
+				t.Fatalf("Update = %+v, %v, called %v", u, err, called)
+			}
+		}},
+		{"update", func(t *testing.T, r registry) {
+			r.Create(&userRecord{Name: "alice", PublicKey: "UA"})
+			u, err := r.Update("alice", func(u *userRecord) error {
+				u.Revoked = true
+				return nil
+			})
+			if err != nil || u == nil || !u.Revoked {
+				t.Fatalf("Update = %+v, %v", u, err)
+			}
+			if u, _ := r.Get("alice"); !u.Revoked {
+				t.Fatal("update was not stored")
+			}
+		}},
+		{"update fails", func(t *testing.T, r registry) {
+			r.Create(&userRecord{Name: "alice", PublicKey: "UA"})
+			u, err := r.Update("alice", func(u *userRecord) error {
+				u.Revoked = true
+				return errRevoked
+			})
+			if u != nil || err != errRevoked {
+				t.Fatalf("Update = %+v, %v", u, err)
+			}
+			if u, _ := r.Get("alice"); u.Revoked {
+				t.Fatal("failed update was stored")
+			}
+		}},
+		{"returned records are copies", func(t *testing.T, r registry) {
+			r.Create(&userRecord{Name: "alice", PublicKey: "UA"})
+			u, _ := r.Get("alice")
+			u.PublicKey = "UB"
+			if u, _ := r.Get("alice"); u.PublicKey != "UA" {
+				t.Fatal("changing a returned record changed the registry")
+			}
+		}},
+		{"list", func(t *testing.T, r registry) {
+			for _, name := range []string{"carol", "alice", "bob"} {
+				r.Create(&userRecord{Name: name, PublicKey: "U" + strings.ToUpper(name)})
+			}
+			r.Update("bob", func(u *userRecord) error {
+				u.Revoked = true
+				return nil
+			})
+			users, err := r.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, u := range users {
+				names = append(names, u.Name)
+			}
+			if want := []string{"alice", "bob", "carol"}; !reflect.DeepEqual(names, want) {
+				t.Fatalf("List = %v, want %v", names, want)
+			}
+			m, err := provisioned(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[string]string{"alice": "UALICE", "carol": "UCAROL"}; !reflect.DeepEqual(m, want) {
+				t.Fatalf("provisioned = %v, want %v", m, want)
+			}
+		}},
+	}
+	for _, store := range stores {
+		for _, tt := range tests {
+			t.Run(store.name+"/"+tt.name, func(t *testing.T) {
+				tt.run(t, store.open(t))
+			})
+		}
+	}
+}
+
+func TestFileRegistryReopen(t *testing.T) {
+	file := filepath.Join(tempDir(t), "users.json")
+	r, err := openFileRegistry(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Create(&userRecord{Name: "alice", PublicKey: "UA"})
+	r.Create(&userRecord{Name: "bob", PublicKey: "UB"})
+	r.Update("alice", func(u *userRecord) error {
+		u.Revoked = true
+		return nil
+	})
+	r.Close()
+
+	// The last record for a name wins.
+	if r, err = openFileRegistry(file); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if u, _ := r.Get("alice"); u == nil || !u.Revoked {
+		t.Fatalf("alice reads back as %+v", u)
+	}
+	if u, _ := r.Get("bob"); u == nil || u.PublicKey != "UB" {
+		t.Fatalf("bob reads back as %+v", u)
+	}
+
+	bad := filepath.Join(tempDir(t), "users.json")
+	if err := ioutil.WriteFile(bad, []byte("{\"name\": \"alice\"}\nnot json\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openFileRegistry(bad); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Fatalf("expected an error for line 2, got %v", err)
+	}
+}
+
+func TestKVRegistryUpdateConflict(t *testing.T) {
+	tests := []struct {
+		name  string
+		races int
+		calls int
+		err   error
+	}{
+		{"no race", 0, 1, nil},
+		{"retried", 1, 2, nil},
+		{"retried more", maxUpdateTries - 1, maxUpdateTries, nil},
+		{"gives up", maxUpdateTries, maxUpdateTries, errUpdateConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := newMemKV()
+			r := &kvRegistry{kv: kv}
+			if err := r.Create(&userRecord{Name: "alice", PublicKey: "UA"}); err != nil {
+				t.Fatal(err)
+			}
+			// Someone else changes the record right before we store ours.
+			races := 0
+			kv.beforeUpdate = func(key string) {
+				if races < tt.races {
+					races++
+					e, _ := kv.Get(key)
+					kv.Put(key, e.Value())
+				}
+			}
+			calls := 0
+			u, err := r.Update("alice", func(u *userRecord) error {
+				calls++
+				u.ServerID = fmt.Sprint(calls)
+				return nil
+			})
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if calls != tt.calls {
+				t.Errorf("fn called %d times, want %d", calls, tt.calls)
+			}
+			if err == nil && u.ServerID != fmt.Sprint(tt.calls) {
+				t.Errorf("stored the update of call %s", u.ServerID)
+			}
+		})
+	}
+}
+
+func TestKVRegistryUpdateError(t *testing.T) {
+	// Failures other than a lost race are not retried.
+	kv := newMemKV()
+	r := &kvRegistry{kv: kv}
+	r.Create(&userRecord{Name: "alice", PublicKey: "UA"})
+	broken := errors.New("broken")
+	calls := 0
+	kv.beforeUpdate = func(string) { calls++ }
+	r.kv = &failingKV{kv, broken}
+	if _, err := r.Update("alice", func(u *userRecord) error { return nil }); err != broken {
+		t.Fatalf("got error %v, want %v", err, broken)
+	}
+	if calls != 1 {
+		t.Fatalf("tried %d times", calls)
+	}
+}
+
+// failingKV fails all updates with err.
+type failingKV struct {
+	*memKV
+	err error
+}
+
+func (kv *failingKV) Update(key string, value []byte, last uint64) (uint64, error) {
+	kv.beforeUpdate(key)
+	return 0, kv.err
+}
+
+func TestAcquire(t *testing.T) {
+	ttl := time.Minute
+	tests := []struct {
+		name    string
+		held    *leaseRecord
+		holder  string
+		want    bool
+		renewed bool
+	}{
+		{"free", nil, "a", true, true},
+		{"renew", &leaseRecord{"a", time.Now()}, "a", true, true},
+		{"held", &leaseRecord{"b", time.Now()}, "a", false, false},
+		{"stale", &leaseRecord{"b", time.Now().Add(-2 * ttl)}, "a", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := newMemKV()
+			r := &kvRegistry{kv: kv}
+			if tt.held != nil {
+				data, _ := json.Marshal(tt.held)
+				kv.Put(leaseKeyPrefix+"sweep", data)
+			}
+			if got := r.acquire("sweep", tt.holder, ttl); got != tt.want {
+				t.Fatalf("acquire = %v, want %v", got, tt.want)
+			}
+			e, _ := kv.Get(leaseKeyPrefix + "sweep")
+			var l leaseRecord
+			json.Unmarshal(e.Value(), &l)
+			if renewed := l.Holder == tt.holder && time.Since(l.Renewed) < time.Second; renewed != tt.renewed {
+				t.Errorf("lease is %+v", l)
+			}
+			// Leases do not show up as users.
+			if users, err := r.List(); err != nil || len(users) != 0 {
+				t.Errorf("List = %v, %v", users, err)
+			}
+		})
+	}
+}
+
+func TestKVKey(t *testing.T) {
+	for _, name := range []string{"alice", "a.b", "a b", "ünï", "*", ">"} {
+		key := kvKey(name)
+		if strings.ContainsAny(key, ".*> ") || strings.HasPrefix(key, leaseKeyPrefix) {
+			t.Errorf("kvKey(%q) = %q is not a valid user key", name, key)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// How far off the nonce timestamp can be from our clock. Replaying a
+// renewal only hands out a JWT that is useless without the user's seed.
+const maxNonceSkew = 2 * time.Minute
+
+// Users renewing their credentials.
+func (as *accessService) handleRenew(m *nats.Msg) {
+	var req renewRequest
+	if aerr := decodeRequest(m.Data, &req); aerr != nil {
+		respondJSON(m, &renewResponse{responseHeader: newResponseHeader(&req.requestHeader, aerr)})
+		return
+	}
+	ujwt, exp, err := as.renewUser(&req)
+	if err != nil {
+		respondJSON(m, &renewResponse{responseHeader: newResponseHeader(&req.requestHeader, toAPIError(err))})
+		return
+	}
+	respondJSON(m, &renewResponse{
+		responseHeader: newResponseHeader(&req.requestHeader, nil),
+		JWT:            ujwt,
+		Expires:        exp,
+	})
+}
+
+// renewUser checks the request was signed by the nkey registered for
+// the user, and that it has neither expired nor been revoked, and then
+// issues a new JWT for the same nkey with the same role.
+func (as *accessService) renewUser(req *renewRequest) (string, int64, error) {
+	name, nkey := req.Name, req.NKey
+	if req.JWT != "" {
+		uc, err := jwt.DecodeUserClaims(req.JWT)
+		if err != nil {
+			return "", 0, errBadRequest
+		}
+		name, nkey = uc.Name, uc.Subject
+	}
+	if name == "" || nkey == "" {
+		return "", 0, errBadRequest
+	}
+	now := time.Now()
+	if err := verifyNonce(nkey, req.Nonce, req.Sig, now); err != nil {
+		return "", 0, err
+	}
+
+	// The JWT is only handed out if the record we checked is the one
+	// stored, a revocation in the meantime makes us check again.
+	var ujwt string
+	var exp int64
+	u, err := as.reg.Update(name, func(u *userRecord) error {
+		if u.PublicKey != nkey {
+			return errUnknownUser
+		}
+		if u.Revoked {
+			return errRevoked
+		}
+		if !u.Expires.IsZero() && u.Expires.Before(now) {
+			return errExpired
+		}
+
+		// Renew with the role we issued, unless it is no longer configured.
+		roleName, r, err := as.roles.lookup(u.Role, false)
+		if err != nil {
+			return err
+		}
+		nuc, err := as.newUserClaims(u.PublicKey, u.Name, roleName, r, now.Add(r.lifetime(0)))
+		if err != nil {
+			return err
+		}
+		if ujwt, err = nuc.Encode(as.sk); err != nil {
+			return err
+		}
+		exp = nuc.Expires
+		u.Expires, u.JWT = time.Unix(exp, 0).UTC(), ujwt
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	if u == nil {
+		return "", 0, errUnknownUser
+	}
+	log.Printf("Renewed %q until %v\n", u.Name, u.Expires)
+	as.audit(&auditRecord{
+		Action:    actionRenew,
+		User:      u.Name,
+		PublicKey: u.PublicKey,
+		Role:      u.Role,
+		Expires:   u.Expires,
+		Actor:     u.Name,
+	})
+	return ujwt, exp, nil
+}
+
+// verifyNonce checks sig is pub's signature of a recent nonce.
+func verifyNonce(pub, nonce, sig string, now time.Time) error {
+	ts := strings.SplitN(nonce, ".", 2)[0]
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errBadRequest
+	}
+	if d := now.Sub(time.Unix(secs, 0)); d > maxNonceSkew || d < -maxNonceSkew {
+		return errStaleNonce
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return errBadSignature
+	}
+	kp, err := nkeys.FromPublicKey(pub)
+	if err != nil {
+		return errBadSignature
+	}
+	if err := kp.Verify([]byte(nonce), raw); err != nil {
+		return errBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/connecteverything/oscon2019/creds"
+	jwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "chat-access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// memAudit keeps the audit trail in memory.
+type memAudit struct {
+	sync.Mutex
+	records []*auditRecord
+}
+
+func (a *memAudit) Append(r *auditRecord) error {
+	a.Lock()
+	defer a.Unlock()
+	a.records = append(a.records, r)
+	return nil
+}
+
+func (a *memAudit) Query(q *auditQuery) ([]*auditRecord, error) {
+	a.Lock()
+	defer a.Unlock()
+	var records []*auditRecord
+	for _, r := range a.records {
+		if q.match(r) {
+			records = append(records, r)
+		}
+	}
+	return q.limit(records), nil
+}
+
+func (a *memAudit) Close() error {
+	return nil
+}
+
+// newTestService returns a service issuing with a signing key of a new
+// account, keeping users in a file registry.
+func newTestService(t *testing.T, roles *roleConfig) *accessService {
+	t.Helper()
+	akp, err := nkeys.CreateAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skp, err := nkeys.CreateAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	apub, _ := akp.PublicKey()
+	skpub, _ := skp.PublicKey()
+	acc := jwt.NewAccountClaims(apub)
+	acc.SigningKeys.Add(skpub)
+
+	reg, err := openFileRegistry(filepath.Join(tempDir(t), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reg.Close() })
+	return &accessService{
+		acc:       acc,
+		sk:        skp,
+		sid:       "test",
+		reg:       reg,
+		roles:     roles,
+		users:     &userCounter{reg: reg},
+		auditLog:  &memAudit{},
+		adminKeys: make(map[string]bool),
+	}
+}
+
+// issue provisions name with the default role and returns its creds.
+func issue(t *testing.T, as *accessService, name string) *creds.Creds {
+	t.Helper()
+	return issueAs(t, as, name, "")
+}
+
+// signedNonce is what the chat client sends along with renewals.
+func signedNonce(t *testing.T, kp nkeys.KeyPair, at time.Time) (string, string) {
+	t.Helper()
+	nonce := fmt.Sprintf("%d.%s", at.Unix(), "0123456789abcdef0123456789abcdef")
+	sig, err := kp.Sign([]byte(nonce))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nonce, base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifyNonce(t *testing.T) {
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	other, _ := nkeys.CreateUser()
+	opub, _ := other.PublicKey()
+	now := time.Now()
+
+	nonce, sig := signedNonce(t, kp, now)
+	stale, staleSig := signedNonce(t, kp, now.Add(-2*maxNonceSkew))
+	future, futureSig := signedNonce(t, kp, now.Add(2*maxNonceSkew))
+
+	tests := []struct {
+		name            string
+		pub, nonce, sig string
+		err             error
+	}{
+		{"valid", pub, nonce, sig, nil},
+		{"stale", pub, stale, staleSig, errStaleNonce},
+		{"future", pub, future, futureSig, errStaleNonce},
+		{"no timestamp", pub, "nonce", sig, errBadRequest},
+		{"other key", opub, nonce, sig, errBadSignature},
+		{"not a key", "UABC", nonce, sig, errBadSignature},
+		{"bad encoding", pub, nonce, "!!!", errBadSignature},
+		{"changed nonce", pub, nonce + "0", sig, errBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyNonce(tt.pub, tt.nonce, tt.sig, now); err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+// Renewals are published with the user's own credentials, so they have
+// to fit every role's payload limit.
+func TestRenewRequestSize(t *testing.T) {
+	shipped, err := loadRoles("roles.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	nonce, sig := signedNonce(t, kp, time.Now())
+	req, err := json.Marshal(&renewRequest{
+		requestHeader: requestHeader{Version: protocolVersion},
+		Name:          strings.Repeat("n", maxNameLen),
+		NKey:          pub,
+		Nonce:         nonce,
+		Sig:           sig,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rc := range []*roleConfig{defaultRoles(), shipped} {
+		for name, r := range rc.Roles {
+			if r.MaxPayload > 0 && int64(len(req)) > r.MaxPayload {
+				t.Errorf("renew request of %d bytes is over the %d of role %q", len(req), r.MaxPayload, name)
+			}
+		}
+	}
+}
+
+func TestRenewUser(t *testing.T) {
+	as := newTestService(t, defaultRoles())
+	c := issue(t, as, "alice")
+	kp, pub := c.KeyPair, c.PublicKey()
+	other, _ := nkeys.CreateUser()
+	opub, _ := other.PublicKey()
+
+	gone := issue(t, as, "gone")
+	if _, err := as.reg.Update("gone", func(u *userRecord) error {
+		u.Revoked = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	old := issue(t, as, "old")
+	if _, err := as.reg.Update("old", func(u *userRecord) error {
+		u.Expires = time.Now().Add(-time.Minute)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name string
+		req  func() *renewRequest
+		err  error
+	}{
+		{"by name", func() *renewRequest {
+			nonce, sig := signedNonce(t, kp, now)
+			return &renewRequest{Name: "alice", NKey: pub, Nonce: nonce, Sig: sig}
+		}, nil},
+		{"by jwt", func() *renewRequest {
+			nonce, sig := signedNonce(t, kp, now)
+			return &renewRequest{JWT: c.JWT, Nonce: nonce, Sig: sig}
+		}, nil},
+		{"missing nkey", func() *renewRequest {
+			nonce, sig := signedNonce(t, kp, now)
+			return &renewRequest{Name: "alice", Nonce: nonce, Sig: sig}
+		}, errBadRequest},
+		{"signed by another key", func() *renewRequest {
+			nonce, sig := signedNonce(t, other, now)
+			return &renewRequest{Name: "alice", NKey: pub, Nonce: nonce, Sig: sig}
+		}, errBadSignature},
+		{"another key for the name", func() *renewRequest {
+			nonce, sig := signedNonce(t, other, now)
+			return &renewRequest{Name: "alice", NKey: opub, Nonce: nonce, Sig: sig}
+		}, errUnknownUser},
+		{"unknown name", func() *renewRequest {
+			nonce, sig := signedNonce(t, kp, now)
+			return &renewRequest{Name: "bob", NKey: pub, Nonce: nonce, Sig: sig}
+		}, errUnknownUser},
+		{"revoked", func() *renewRequest {
+			nonce, sig := signedNonce(t, gone.KeyPair, now)
+			return &renewRequest{Name: "gone", NKey: gone.PublicKey(), Nonce: nonce, Sig: sig}
+		}, errRevoked},
+		{"expired", func() *renewRequest {
+			nonce, sig := signedNonce(t, old.KeyPair, now)
+			return &renewRequest{Name: "old", NKey: old.PublicKey(), Nonce: nonce, Sig: sig}
+		}, errExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ujwt, exp, err := as.renewUser(tt.req())
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			uc, err := jwt.DecodeUserClaims(ujwt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uc.Subject != pub || uc.Name != "alice" || uc.Expires != exp {
+				t.Errorf("renewed the wrong user: %q %q %d", uc.Subject, uc.Name, uc.Expires)
+			}
+			if roleOf(uc) != "member" {
+				t.Errorf("renewed with role %q", roleOf(uc))
+			}
+			u, _ := as.reg.Get("alice")
+			if u.JWT != ujwt {
+				t.Error("registry does not hold the renewed JWT")
+			}
+		})
+	}
+}
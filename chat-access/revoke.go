@@ -0,0 +1,421 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	jwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// Revocation modes. Account adds the user to the account JWT revocations,
+// which needs the operator signing key and the system account. Denylist
+// only records and announces revoked users, clients drop anything from
+// them and renewals are refused, so use it with roles that have a short
+// valid_for. Delegate asks a signer service that holds the operator
+// signing key, e.g. another chat-access running with -serve-signer,
+// which only takes requests signed with one of the account signing
+// keys, like the -sk we sign users with.
+const (
+	revokeAccount  = "account"
+	revokeDenyList = "denylist"
+	revokeDelegate = "delegate"
+)
+
+const (
+	// Announcements of newly revoked users, signed by our account.
+	revokedSub = preSub + "revoked"
+	// Request the full deny-list, signed by our account.
+	revokedSubj = "chat.req.revoked"
+	// Default subject for a delegated signer.
+	signerSubj = "chat.req.sign.revoke"
+
+	// How long a deny-list response can be trusted for.
+	denyListTTL = time.Minute
+)
+
+// revoker makes sure a revoked user can no longer connect.
+type revoker interface {
+	revoke(pub string) error
+	// prune drops revocations that are no longer needed since the
+	// user JWTs have expired, and returns the nkeys it took care of.
+	prune(users []*userRecord) ([]string, error)
+}
+
+// accountRevoker updates the account JWT itself.
+type accountRevoker struct {
+	sync.Mutex
+	sc  *nats.Conn // System account.
+	acc string
+	osk nkeys.KeyPair
+}
+
+// revoke serializes the read-modify-write of the account JWT.
+func (ar *accountRevoker) revoke(pub string) error {
+	ar.Lock()
+	defer ar.Unlock()
+
+	latestAcc, err := ar.lookup()
+	if err != nil {
+		return err
+	}
+	latestAcc.Revoke(pub)
+	return ar.update(latestAcc)
+}
+
+// We trust our own registry on who has expired.
+func (ar *accountRevoker) prune(users []*userRecord) ([]string, error) {
+	pubs := make([]string, 0, len(users))
+	for _, u := range users {
+		pubs = append(pubs, u.PublicKey)
+	}
+	if _, err := ar.clear(pubs); err != nil {
+		return nil, err
+	}
+	return pubs, nil
+}
+
+// clear only updates the account JWT if there is something to drop,
+// and returns how many revocations were dropped.
+func (ar *accountRevoker) clear(pubs []string) (int, error) {
+	ar.Lock()
+	defer ar.Unlock()
+
+	latestAcc, err := ar.lookup()
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, pub := range pubs {
+		if _, ok := latestAcc.Revocations[pub]; ok {
+			latestAcc.ClearRevocation(pub)
+			pruned++
+		}
+	}
+	if pruned == 0 {
+		return 0, nil
+	}
+	return pruned, ar.update(latestAcc)
+}
+
+// Lock should be held.
+func (ar *accountRevoker) lookup() (*jwt.AccountClaims, error) {
+	lookupSubject := fmt.Sprintf("$SYS.REQ.ACCOUNT.%s.CLAIMS.LOOKUP", ar.acc)
+	resp, err := ar.sc.Request(lookupSubject, []byte(""), 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("[Response]", string(resp.Data))
+	return jwt.DecodeAccountClaims(string(resp.Data))
+}
+
+// Lock should be held.
+func (ar *accountRevoker) update(latestAcc *jwt.AccountClaims) error {
+	encoded, err := latestAcc.Encode(ar.osk)
+	if err != nil {
+		return err
+	}
+	log.Println("RESULT:", latestAcc, encoded)
+
+	updateSubject := fmt.Sprintf("$SYS.REQ.ACCOUNT.%s.CLAIMS.UPDATE", ar.acc)
+	_, err = ar.sc.Request(updateSubject, []byte(encoded), 3*time.Second)
+	return err
+}
+
+// denyListRevoker leaves it all to the deny-list.
+type denyListRevoker struct{}
+
+func (denyListRevoker) revoke(pub string) error {
+	return nil
+}
+
+// There are no revocations to prune.
+func (denyListRevoker) prune(users []*userRecord) ([]string, error) {
+	return nil, nil
+}
+
+// Type of the claims we sign for a delegated signer.
+const signClaimType = "chat-sign"
+
+// signRequest is what we send to a delegated signer. Claim is a JWT
+// signed by one of the account signing keys, with the account as sub,
+// carrying either the nkey of a user to revoke, or the user JWTs of
+// expired users whose revocations to prune. The signer checks they
+// have expired itself.
+type signRequest struct {
+	requestHeader
+	Claim string `json:"claim"`
+}
+
+// signResponse is the reply to a signRequest, with the nkeys of the
+// users the signer found expired.
+type signResponse struct {
+	responseHeader
+	Pruned []string `json:"pruned,omitempty"`
+}
+
+// delegateRevoker asks a signer service to update the account JWT.
+type delegateRevoker struct {
+	nc      *nats.Conn
+	subject string
+	acc     string
+	sk      nkeys.KeyPair
+}
+
+func (dr *delegateRevoker) revoke(pub string) error {
+	_, err := dr.request("nkey", pub)
+	return err
+}
+
+// Users we have no JWT for can not be shown to have expired.
+func (dr *delegateRevoker) prune(users []*userRecord) ([]string, error) {
+	var jwts []string
+	for _, u := range users {
+		if u.JWT != "" {
+			jwts = append(jwts, u.JWT)
+		}
+	}
+	if len(jwts) == 0 {
+		return nil, nil
+	}
+	return dr.request("prune", jwts)
+}
+
+func (dr *delegateRevoker) request(key string, value interface{}) ([]string, error) {
+	claim := jwt.NewGenericClaims(dr.acc)
+	claim.Expires = time.Now().Add(maxNonceSkew).Unix()
+	claim.Data["type"] = signClaimType
+	claim.Data[key] = value
+	cjwt, err := claim.Encode(dr.sk)
+	if err != nil {
+		return nil, err
+	}
+	req := &signRequest{requestHeader: requestHeader{Version: protocolVersion}, Claim: cjwt}
+
+	var resp signResponse
+	if err := requestJSON(dr.nc, dr.subject, req, &resp, 5*time.Second); err != nil {
+		return nil, err
+	}
+	if resp.Status != statusOK {
+		return nil, fmt.Errorf("signer: %s: %s", resp.Error, resp.Description)
+	}
+	return resp.Pruned, nil
+}
+
+// serveSigner answers delegated revocations for our account only, from
+// those holding one of its signing keys.
+func serveSigner(nc *nats.Conn, subject string, ar *accountRevoker, acc *jwt.AccountClaims) error {
+	_, err := nc.QueueSubscribe(subject, reqGroup, func(m *nats.Msg) {
+		var req signRequest
+		var pub string
+		var expired []string
+		aerr := decodeRequest(m.Data, &req)
+		if aerr == nil {
+			pub, expired, aerr = openSignRequest(&req, acc)
+		}
+		if aerr == nil && pub != "" {
+			if err := ar.revoke(pub); err != nil {
+				aerr = toAPIError(err)
+			} else {
+				log.Printf("Signed revocation of %q", pub)
+			}
+		}
+		if aerr == nil && len(expired) > 0 {
+			if n, err := ar.clear(expired); err != nil {
+				aerr = toAPIError(err)
+			} else {
+				log.Printf("Signed pruning of %d revocations", n)
+			}
+		}
+		if aerr != nil {
+			expired = nil
+		}
+		respondJSON(m, &signResponse{
+			responseHeader: newResponseHeader(&req.requestHeader, aerr),
+			Pruned:         expired,
+		})
+	})
+	return err
+}
+
+// openSignRequest checks the claim is a fresh one for our account
+// signed by one of its signing keys. It returns the user to revoke,
+// and the users to prune that we found expired.
+func openSignRequest(req *signRequest, acc *jwt.AccountClaims) (string, []string, *apiError) {
+	gc, err := jwt.DecodeGeneric(req.Claim)
+	if err != nil {
+		return "", nil, errBadSignature
+	}
+	if t, _ := gc.Data["type"].(string); t != signClaimType || gc.Subject != acc.Subject {
+		return "", nil, errBadRequest
+	}
+	if gc.Issuer != acc.Subject && !acc.SigningKeys.Contains(gc.Issuer) {
+		return "", nil, errNotSigningKey
+	}
+	now := time.Now()
+	if d := now.Sub(time.Unix(gc.IssuedAt, 0)); d > maxNonceSkew || d < -maxNonceSkew {
+		return "", nil, errStaleNonce
+	}
+	if gc.Expires > 0 && gc.Expires < now.Unix() {
+		return "", nil, errExpired
+	}
+
+	pub, _ := gc.Data["nkey"].(string)
+	if pub != "" && !nkeys.IsValidPublicUserKey(pub) {
+		return "", nil, errBadRequest
+	}
+	jwts, _ := gc.Data["prune"].([]interface{})
+	if pub == "" && len(jwts) == 0 {
+		return "", nil, errBadRequest
+	}
+	var expired []string
+	for _, v := range jwts {
+		ujwt, _ := v.(string)
+		uc, err := jwt.DecodeUserClaims(ujwt)
+		if err != nil {
+			return "", nil, errBadRequest
+		}
+		issuer := uc.Issuer == acc.Subject || acc.SigningKeys.Contains(uc.Issuer)
+		if !issuer || uc.Expires == 0 || uc.Expires > now.Unix() {
+			log.Printf("Not pruning %q, its JWT is not an expired one of ours", uc.Subject)
+			continue
+		}
+		expired = append(expired, uc.Subject)
+	}
+	return pub, expired, nil
+}
+
+// pruneRevocations drops revocations of users whose JWTs have expired,
+// they can not connect anymore anyway, to keep the account JWT from
+// growing without bound. Revoked users are never renewed.
+func (as *accessService) pruneRevocations() {
+	users, err := as.reg.List()
+	if err != nil {
+		log.Println("Error: ", err)
+		return
+	}
+	now := time.Now()
+	var expired []*userRecord
+	for _, u := range users {
+		if u.Revoked && !u.Pruned && !u.Expires.IsZero() && u.Expires.Before(now) {
+			expired = append(expired, u)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	pruned, err := as.revoker.prune(expired)
+	if err != nil {
+		log.Printf("Error pruning revocations: %v", err)
+		return
+	}
+	if len(pruned) == 0 {
+		return
+	}
+	log.Printf("Pruned %d of %d expired revocations", len(pruned), len(expired))
+
+	done := make(map[string]bool, len(pruned))
+	for _, pub := range pruned {
+		done[pub] = true
+	}
+	for _, u := range expired {
+		if !done[u.PublicKey] {
+			continue
+		}
+		u, err := as.reg.Update(u.Name, func(u *userRecord) error {
+			u.Pruned = true
+			return nil
+		})
+		if err != nil {
+			log.Println("Error: ", err)
+			continue
+		}
+		if u == nil {
+			continue
+		}
+		as.audit(&auditRecord{
+			Action:    actionPrune,
+			User:      u.Name,
+			PublicKey: u.PublicKey,
+			Role:      u.Role,
+			Expires:   u.Expires,
+			Actor:     auditActor,
+			Reason:    "expired",
+		})
+	}
+}
+
+// prune will periodically prune revocations until nc is closed. When
+// elect is set only the replica it elects prunes, so replicas do not
+// overwrite each others updates of the account JWT.
+func (as *accessService) prune(interval time.Duration, elect func() bool) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		if as.nc.IsClosed() {
+			return
+		}
+		if elect != nil && !elect() {
+			continue
+		}
+		as.pruneRevocations()
+	}
+}
+
+// publishRevoked tells everyone u can no longer be trusted.
+func (as *accessService) publishRevoked(u *userRecord) {
+	claim := jwt.NewGenericClaims(u.PublicKey)
+	claim.Name = u.Name
+	claim.Data["type"] = "chat-revoked"
+	rjwt, err := claim.Encode(as.sk)
+	if err != nil {
+		log.Println("Error: ", err)
+		return
+	}
+	as.nc.Publish(revokedSub, []byte(rjwt))
+}
+
+// Anyone can ask for the current deny-list. It carries our signing
+// keys too, so clients can verify the user JWTs we issue.
+func (as *accessService) handleRevoked(m *nats.Msg) {
+	users, err := as.reg.List()
+	if err != nil {
+		m.Respond(toAPIError(err).legacyResponse())
+		return
+	}
+	// Users that have expired since can be left out.
+	now := time.Now()
+	revoked := []string{}
+	for _, u := range users {
+		if u.Revoked && (u.Expires.IsZero() || u.Expires.After(now)) {
+			revoked = append(revoked, u.PublicKey)
+		}
+	}
+	claim := jwt.NewGenericClaims(as.acc.Subject)
+	claim.Expires = time.Now().Add(denyListTTL).Unix()
+	claim.Data["type"] = "chat-revoked-list"
+	claim.Data["revoked"] = revoked
+	claim.Data["signing_keys"] = as.acc.SigningKeys
+	rjwt, err := claim.Encode(as.sk)
+	if err != nil {
+		m.Respond(toAPIError(err).legacyResponse())
+		return
+	}
+	m.Respond([]byte(rjwt))
+}
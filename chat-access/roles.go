@@ -0,0 +1,216 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+	"unicode"
+
+	jwt "github.com/nats-io/jwt/v2"
+)
+
+// duration is a time.Duration that reads as "24h" etc. in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// role is a named template for the users we provision. Subjects can
+// reference {{pubkey}} and {{name}} which are filled in per user.
+// Limits left at zero are unlimited.
+type role struct {
+	PubAllow   []string `json:"pub_allow,omitempty"`
+	PubDeny    []string `json:"pub_deny,omitempty"`
+	SubAllow   []string `json:"sub_allow,omitempty"`
+	SubDeny    []string `json:"sub_deny,omitempty"`
+	MaxPayload int64    `json:"max_payload,omitempty"`
+	MaxSubs    int64    `json:"max_subs,omitempty"`
+	MaxData    int64    `json:"max_data,omitempty"`
+	Bearer     bool     `json:"bearer,omitempty"`
+	ValidFor   duration `json:"valid_for,omitempty"`
+	// Admin users can use the admin API, so it can not be requested.
+	Admin bool `json:"admin,omitempty"`
+}
+
+// roleConfig is what we load with -roles.
+type roleConfig struct {
+	// Default is used when a request does not ask for a role.
+	Default string `json:"default"`
+	// Allowed are the roles anyone may request on chat.req.access,
+	// the others are only issued by admins on chat.req.provision.
+	Allowed []string         `json:"allowed"`
+	Roles   map[string]*role `json:"roles"`
+}
+
+// defaultRoles matches what we always handed out before roles existed.
+func defaultRoles() *roleConfig {
+	return &roleConfig{
+		Default: "member",
+		Allowed: []string{"member"},
+		Roles: map[string]*role{
+			"member": {
+				// Can listen for DMs, but only to ones to ourselves.
+				PubAllow: []string{onlineSub, postsSub, dmsPub, typingSub, typingDMPub, chansSub, reactSub,
+					renewSubj, revokedSubj, histCreate, histDelete, histFlow, histDMCreate},
+				SubAllow: []string{onlineSub, postsSub, dmsSub, typingSub, typingDMSub, chansSub, reactSub,
+					revokedSub, inboxSub},
+				MaxPayload: maxMsgSize,
+				ValidFor:   duration(validFor),
+			},
+		},
+	}
+}
+
+func loadRoles(file string) (*roleConfig, error) {
+	if file == "" {
+		return defaultRoles(), nil
+	}
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rc roleConfig
+	if err := json.Unmarshal(contents, &rc); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	// Role names go into the JWT as tags, which are always lower case.
+	// Users announce their presence with their JWT, which has to fit.
+	for name, r := range rc.Roles {
+		if name == "" || name != strings.ToLower(name) || strings.IndexFunc(name, unicode.IsSpace) >= 0 {
+			return nil, fmt.Errorf("%s: role %q has to be a lower case word", file, name)
+		}
+		if r.MaxPayload > 0 && r.MaxPayload < maxMsgSize {
+			return nil, fmt.Errorf("%s: role %q has to allow a max_payload of at least %d", file, name, maxMsgSize)
+		}
+	}
+	if rc.Roles[rc.Default] == nil {
+		return nil, fmt.Errorf("%s: default role %q is not defined", file, rc.Default)
+	}
+	if rc.Roles[rc.Default].Admin {
+		return nil, fmt.Errorf("%s: default role %q can not be an admin role", file, rc.Default)
+	}
+	for _, name := range rc.Allowed {
+		if rc.Roles[name] == nil {
+			return nil, fmt.Errorf("%s: allowed role %q is not defined", file, name)
+		}
+		if rc.Roles[name].Admin {
+			return nil, fmt.Errorf("%s: allowed role %q can not be an admin role", file, name)
+		}
+	}
+	return &rc, nil
+}
+
+// hasAdmin tells if any role can use the admin API.
+func (rc *roleConfig) hasAdmin() bool {
+	for _, r := range rc.Roles {
+		if r.Admin {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the role to use for a request. When restricted is set
+// only roles listed as allowed can be selected.
+func (rc *roleConfig) lookup(name string, restricted bool) (string, *role, error) {
+	if name == "" {
+		name = rc.Default
+	}
+	r := rc.Roles[name]
+	if r == nil {
+		return "", nil, errUnknownRole
+	}
+	if !restricted || name == rc.Default {
+		return name, r, nil
+	}
+	for _, a := range rc.Allowed {
+		if a == name {
+			return name, r, nil
+		}
+	}
+	return "", nil, errRoleNotAllowed
+}
+
+// lifetime caps the requested lifetime to what the role allows.
+func (r *role) lifetime(requested time.Duration) time.Duration {
+	max := time.Duration(r.ValidFor)
+	if max <= 0 {
+		max = validFor
+	}
+	if requested <= 0 || requested > max {
+		return max
+	}
+	return requested
+}
+
+// validName tells if name is a single subject token, so putting it in
+// place of {{name}} can not turn a subject into a wildcard.
+func validName(name string) bool {
+	if name == "" || strings.ContainsAny(name, ".*>") {
+		return false
+	}
+	return strings.IndexFunc(name, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) < 0
+}
+
+// apply will set permissions and limits on the user claims. Names that
+// are not a single subject token are rejected.
+func (r *role) apply(nuc *jwt.UserClaims, name string) error {
+	if !validName(name) {
+		return errBadName
+	}
+	rp := strings.NewReplacer("{{pubkey}}", nuc.Subject, "{{name}}", name)
+	expand := func(subjects []string) jwt.StringList {
+		var sl jwt.StringList
+		for _, s := range subjects {
+			sl.Add(rp.Replace(s))
+		}
+		return sl
+	}
+	nuc.Permissions.Pub.Allow = expand(r.PubAllow)
+	nuc.Permissions.Pub.Deny = expand(r.PubDeny)
+	nuc.Permissions.Sub.Allow = expand(r.SubAllow)
+	nuc.Permissions.Sub.Deny = expand(r.SubDeny)
+
+	limit := func(v int64) int64 {
+		if v <= 0 {
+			return jwt.NoLimit
+		}
+		return v
+	}
+	nuc.Limits.Payload = limit(r.MaxPayload)
+	nuc.Limits.Subs = limit(r.MaxSubs)
+	nuc.Limits.Data = limit(r.MaxData)
+	nuc.BearerToken = r.Bearer
+	return nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/connecteverything/oscon2019/creds"
+	jwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+func writeRoles(t *testing.T, contents string) string {
+	t.Helper()
+	file := filepath.Join(tempDir(t), "roles.json")
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadRoles(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		ok       bool
+	}{
+		{"minimal", `{"default": "member", "roles": {"member": {}}}`, true},
+		{"allowed", `{"default": "member", "allowed": ["guest"], "roles": {"member": {}, "guest": {}}}`, true},
+		{"admin role", `{"default": "member", "roles": {"member": {}, "admin": {"admin": true}}}`, true},
+		{"missing default", `{"default": "member", "roles": {"guest": {}}}`, false},
+		{"admin default", `{"default": "admin", "roles": {"admin": {"admin": true}}}`, false},
+		{"allowed admin", `{"default": "member", "allowed": ["admin"], "roles": {"member": {}, "admin": {"admin": true}}}`, false},
+		{"unknown allowed", `{"default": "member", "allowed": ["guest"], "roles": {"member": {}}}`, false},
+		{"upper case role", `{"default": "member", "roles": {"member": {}, "Moderator": {}}}`, false},
+		{"role with spaces", `{"default": "member", "roles": {"member": {}, "a role": {}}}`, false},
+		{"small payload", `{"default": "member", "roles": {"member": {"max_payload": 512}}}`, false},
+		{"bad duration", `{"default": "member", "roles": {"member": {"valid_for": "forever"}}}`, false},
+		{"not json", `default: member`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadRoles(writeRoles(t, tt.contents))
+			if tt.ok && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestLoadRolesShipped(t *testing.T) {
+	rc, err := loadRoles("roles.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range rc.Roles {
+		nuc := jwt.NewUserClaims("UABC")
+		nuc.Tags.Add(roleTagPrefix + name)
+		if got := roleOf(nuc); got != name {
+			t.Errorf("role %q reads back as %q", name, got)
+		}
+	}
+}
+
+// Presence is published with the user's own credentials and carries
+// their JWT, so it has to fit the payload limit of every role.
+func TestOnlineClaimSize(t *testing.T) {
+	shipped, err := loadRoles("roles.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	xkp, err := nkeys.CreateCurveKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpub, _ := xkp.PublicKey()
+	name := strings.Repeat("n", maxNameLen)
+
+	for _, rc := range []*roleConfig{defaultRoles(), shipped} {
+		for roleName := range rc.Roles {
+			as := newTestService(t, rc)
+			ic, err := as.generateUserCreds(name, roleName, false, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := creds.Parse([]byte(ic.creds))
+			if err != nil {
+				t.Fatal(err)
+			}
+			nuc, err := jwt.DecodeUserClaims(c.JWT)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// What chat sends when it comes online.
+			online := jwt.NewGenericClaims(nuc.Subject)
+			online.Name = nuc.Name
+			online.Expires = time.Now().Add(time.Minute).Unix()
+			online.Data["status"] = "online"
+			online.Data["jwt"] = c.JWT
+			online.Data["xkey"] = xpub
+			online.Data["type"] = "chat-online"
+			online.Data["tags"] = []string{"new"}
+			ojwt, err := online.Encode(c.KeyPair)
+			c.Wipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nuc.Limits.Payload != jwt.NoLimit && int64(len(ojwt)) > nuc.Limits.Payload {
+				t.Errorf("online claim of %d bytes is over the %d of role %q", len(ojwt), nuc.Limits.Payload, roleName)
+			}
+		}
+	}
+}
+
+// Creating consumers on the DM stream has to be limited to our own DMs,
+// anything else lets users read everyone's DMs.
+func TestDMHistoryPermission(t *testing.T) {
+	shipped, err := loadRoles("roles.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	for _, rc := range []*roleConfig{defaultRoles(), shipped} {
+		for name, r := range rc.Roles {
+			nuc := jwt.NewUserClaims(pub)
+			if err := r.apply(nuc, "alice"); err != nil {
+				t.Fatal(err)
+			}
+			for _, subj := range nuc.Permissions.Pub.Allow {
+				if !strings.HasPrefix(subj, "$JS.API.CONSUMER.") || !strings.Contains(subj, "CHAT_DMS") {
+					continue
+				}
+				if want := "$JS.API.CONSUMER.CREATE.CHAT_DMS.*.chat.KUBECON.dms." + pub; subj != want {
+					t.Errorf("role %q may use %q, only %q is safe", name, subj, want)
+				}
+			}
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	rc := &roleConfig{
+		Default: "member",
+		Allowed: []string{"guest"},
+		Roles: map[string]*role{
+			"member":    {},
+			"guest":     {},
+			"moderator": {},
+		},
+	}
+	tests := []struct {
+		role       string
+		restricted bool
+		want       string
+		err        error
+	}{
+		{"", true, "member", nil},
+		{"member", true, "member", nil},
+		{"guest", true, "guest", nil},
+		{"moderator", true, "", errRoleNotAllowed},
+		{"moderator", false, "moderator", nil},
+		{"nobody", false, "", errUnknownRole},
+		{"nobody", true, "", errUnknownRole},
+	}
+	for _, tt := range tests {
+		got, _, err := rc.lookup(tt.role, tt.restricted)
+		if got != tt.want || err != tt.err {
+			t.Errorf("lookup(%q, %v) = %q, %v, want %q, %v", tt.role, tt.restricted, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestLifetime(t *testing.T) {
+	r := &role{ValidFor: duration(24 * time.Hour)}
+	tests := []struct {
+		requested, want time.Duration
+	}{
+		{0, 24 * time.Hour},
+		{-time.Hour, 24 * time.Hour},
+		{time.Hour, time.Hour},
+		{48 * time.Hour, 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := r.lifetime(tt.requested); got != tt.want {
+			t.Errorf("lifetime(%v) = %v, want %v", tt.requested, got, tt.want)
+		}
+	}
+	if got := (&role{}).lifetime(0); got != validFor {
+		t.Errorf("lifetime without a limit = %v, want %v", got, validFor)
+	}
+}
+
+func TestApply(t *testing.T) {
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := kp.PublicKey()
+	r := &role{
+		PubAllow:   []string{"chat.{{name}}.posts"},
+		SubAllow:   []string{"chat.dms.{{pubkey}}"},
+		MaxPayload: 2048,
+		Bearer:     true,
+	}
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"alice", nil},
+		{"bob-2", nil},
+		{"", errBadName},
+		{">", errBadName},
+		{"*", errBadName},
+		{"a.*", errBadName},
+		{"a.b", errBadName},
+		{"a>", errBadName},
+		{"a b", errBadName},
+		{"a\tb", errBadName},
+		{"a\x00", errBadName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nuc := jwt.NewUserClaims(pub)
+			if err := r.apply(nuc, tt.name); err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+			if want := "chat." + tt.name + ".posts"; !nuc.Permissions.Pub.Allow.Contains(want) {
+				t.Errorf("pub allow %v is missing %q", nuc.Permissions.Pub.Allow, want)
+			}
+			if want := "chat.dms." + pub; !nuc.Permissions.Sub.Allow.Contains(want) {
+				t.Errorf("sub allow %v is missing %q", nuc.Permissions.Sub.Allow, want)
+			}
+			if nuc.Limits.Payload != 2048 || nuc.Limits.Subs != jwt.NoLimit || !nuc.BearerToken {
+				t.Errorf("limits not applied: %+v", nuc.Limits)
+			}
+		})
+	}
+}
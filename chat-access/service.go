@@ -0,0 +1,363 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	jwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	provSubj        = "chat.req.provisioned"
+	provUpdatesSubj = "chat.req.provisioned.updates"
+	// Admins issuing credentials with any role.
+	provisionSubj = "chat.req.provision"
+)
+
+// accessService provisions and revokes chat users.
+type accessService struct {
+	nc    *nats.Conn // ADMIN account, serves our API.
+	acc   *jwt.AccountClaims
+	sk    nkeys.KeyPair
+	sid   string
+	reg   registry
+	roles *roleConfig
+
+	// checks are run on every access request before we sign.
+	checks []admissionCheck
+	// users counts the active users for the checks.
+	users *userCounter
+	// trustProxy is set when the source headers can be trusted.
+	trustProxy bool
+
+	// revoker is how revoked users are kept out.
+	revoker revoker
+
+	// auditLog records who was provisioned and revoked.
+	auditLog auditLog
+
+	// adminKeys can always use the admin API.
+	adminKeys map[string]bool
+}
+
+// start will subscribe to all of our API subjects.
+// When coordinated only one replica will handle online events.
+func (as *accessService) start(coordinated bool) error {
+	nc := as.nc
+	if _, err := nc.QueueSubscribe(reqSubj, reqGroup, as.handleAccess); err != nil {
+		return err
+	}
+	var err error
+	if coordinated {
+		_, err = nc.QueueSubscribe(onlineSub, reqGroup, as.handleOnline)
+	} else {
+		_, err = nc.Subscribe(onlineSub, as.handleOnline)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := nc.QueueSubscribe(provSubj, reqGroup, as.handleProvisioned); err != nil {
+		return err
+	}
+	if _, err := nc.QueueSubscribe(provisionSubj, reqGroup, as.handleProvision); err != nil {
+		return err
+	}
+	if _, err := nc.QueueSubscribe(revSubj, reqGroup, as.handleRevoke); err != nil {
+		return err
+	}
+	if _, err := nc.QueueSubscribe(renewSubj, reqGroup, as.handleRenew); err != nil {
+		return err
+	}
+	if _, err := nc.QueueSubscribe(revokedSubj, reqGroup, as.handleRevoked); err != nil {
+		return err
+	}
+	if _, err := nc.QueueSubscribe(auditQuerySubj, reqGroup, as.handleAuditQuery); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Subscribe to user provisioning requests.
+func (as *accessService) handleAccess(m *nats.Msg) {
+	if !isJSONRequest(m.Data) {
+		if len(m.Data) == 0 {
+			m.Respond(errEmptyName.legacyResponse())
+			return
+		}
+		reqName := simpleName(m.Data)
+		ar := &admissionRequest{Name: reqName, Source: as.requestSource(m)}
+		if err := admit(as.checks, ar); err != nil {
+			log.Printf("Rejected %q [%q]: %v\n", reqName, m.Data, err)
+			m.Respond(toAPIError(err).legacyResponse())
+			return
+		}
+		log.Printf("Registered %q [%q]\n", reqName, m.Data)
+		ic, err := as.generateUserCreds(reqName, "", true, 0)
+		if err != nil {
+			m.Respond(toAPIError(err).legacyResponse())
+			return
+		}
+		m.Respond([]byte(ic.creds))
+		as.auditProvision(reqName, reqName, "", ic, ar.Source)
+		as.publishProvisioned()
+		return
+	}
+
+	var req accessRequest
+	if aerr := decodeRequest(m.Data, &req); aerr != nil {
+		respondJSON(m, &accessResponse{responseHeader: newResponseHeader(&req.requestHeader, aerr)})
+		return
+	}
+	reqName := simpleName([]byte(req.Name))
+	ar := &admissionRequest{Name: reqName, Role: req.Role, Client: req.Client, Source: as.requestSource(m)}
+	if err := admit(as.checks, ar); err != nil {
+		log.Printf("Rejected %q [%q]: %v\n", reqName, req.Name, err)
+		respondJSON(m, &accessResponse{
+			responseHeader: newResponseHeader(&req.requestHeader, toAPIError(err)),
+			Name:           reqName,
+		})
+		return
+	}
+	log.Printf("Registered %q [%q] %+v\n", reqName, req.Name, req.Client)
+
+	lifetime := time.Duration(req.Lifetime) * time.Second
+	ic, err := as.generateUserCreds(reqName, req.Role, true, lifetime)
+	if err != nil {
+		respondJSON(m, &accessResponse{
+			responseHeader: newResponseHeader(&req.requestHeader, toAPIError(err)),
+			Name:           reqName,
+		})
+		return
+	}
+	respondJSON(m, &accessResponse{
+		responseHeader: newResponseHeader(&req.requestHeader, nil),
+		Name:           reqName,
+		Role:           ic.role,
+		Creds:          ic.creds,
+		PublicKey:      ic.pub,
+		Expires:        ic.expires,
+	})
+	as.auditProvision(reqName, reqName, "", ic, ar.Source)
+	as.publishProvisioned()
+}
+
+// The actor is the user itself, unless provisioned by an admin.
+func (as *accessService) auditProvision(name, actor, reason string, ic *issuedCreds, source string) {
+	as.audit(&auditRecord{
+		Action:    actionProvision,
+		User:      name,
+		PublicKey: ic.pub,
+		Role:      ic.role,
+		Expires:   time.Unix(ic.expires, 0).UTC(),
+		Actor:     actor,
+		Reason:    reason,
+		Source:    source,
+	})
+}
+
+// ADMIN provioning users is able to read online events. Anyone can
+// sign an online claim with a fresh nkey, so we only record users that
+// carry a user JWT issued by our account, and never replace a record.
+func (as *accessService) handleOnline(m *nats.Msg) {
+	log.Println("[Received]", string(m.Data))
+
+	tok, err := jwt.DecodeGeneric(string(m.Data))
+	if err != nil {
+		m.Respond([]byte("-ERR " + err.Error()))
+		return
+	}
+	uc, aerr := as.onlineUser(tok)
+	if aerr != nil {
+		m.Respond(aerr.legacyResponse())
+		return
+	}
+
+	ujwt, _ := tok.Data["jwt"].(string)
+	u := &userRecord{
+		Name:      uc.Name,
+		PublicKey: uc.Subject,
+		Role:      roleOf(uc),
+		IssuedAt:  time.Unix(uc.IssuedAt, 0).UTC(),
+		JWT:       ujwt,
+	}
+	if uc.Expires > 0 {
+		u.Expires = time.Unix(uc.Expires, 0).UTC()
+	}
+	// Users we provisioned are already known.
+	if err := as.reg.Create(u); err != nil {
+		if err != errUserExists {
+			log.Println("Error: ", err)
+		}
+		return
+	}
+	as.users.add(1)
+
+	// Tell admin that we've added a new user.
+	as.publishProvisioned()
+}
+
+// onlineUser returns the user JWT sent with an online claim, if it is
+// a current one we issued for the nkey and name of the claim.
+func (as *accessService) onlineUser(tok *jwt.GenericClaims) (*jwt.UserClaims, *apiError) {
+	ujwt, _ := tok.Data["jwt"].(string)
+	if tok.Name == "" || ujwt == "" {
+		return nil, errUnauthenticated
+	}
+	uc, err := jwt.DecodeUserClaims(ujwt)
+	if err != nil {
+		return nil, errBadSignature
+	}
+	if uc.Subject != tok.Issuer || uc.Name != tok.Name || !as.issuedByUs(uc) {
+		return nil, errUnknownUser
+	}
+	if uc.Expires > 0 && uc.Expires < time.Now().Unix() {
+		return nil, errExpired
+	}
+	return uc, nil
+}
+
+// Only admins can list provisioned users.
+func (as *accessService) handleProvisioned(m *nats.Msg) {
+	if !isJSONRequest(m.Data) {
+		m.Respond(errUnauthenticated.legacyResponse())
+		return
+	}
+
+	var req provisionedRequest
+	if aerr := decodeRequest(m.Data, &req); aerr != nil {
+		respondJSON(m, &provisionedResponse{responseHeader: newResponseHeader(&req.requestHeader, aerr)})
+		return
+	}
+	if _, err := as.authorizeAdmin(req.Auth, provSubj, ""); err != nil {
+		respondJSON(m, &provisionedResponse{responseHeader: newResponseHeader(&req.requestHeader, toAPIError(err))})
+		return
+	}
+	users, err := provisioned(as.reg)
+	if err != nil {
+		respondJSON(m, &provisionedResponse{responseHeader: newResponseHeader(&req.requestHeader, toAPIError(err))})
+		return
+	}
+	respondJSON(m, &provisionedResponse{
+		responseHeader: newResponseHeader(&req.requestHeader, nil),
+		Users:          users,
+	})
+}
+
+// Only admins can revoke users, legacy requests have no way
+// to tell us who is asking.
+func (as *accessService) handleRevoke(m *nats.Msg) {
+	if !isJSONRequest(m.Data) {
+		m.Respond(errUnauthenticated.legacyResponse())
+		return
+	}
+
+	var req revokeRequest
+	if aerr := decodeRequest(m.Data, &req); aerr != nil {
+		respondJSON(m, &revokeResponse{responseHeader: newResponseHeader(&req.requestHeader, aerr)})
+		return
+	}
+	reqName := simpleName([]byte(req.Name))
+	actor, err := as.authorizeAdmin(req.Auth, revSubj, reqName)
+	if err != nil {
+		log.Printf("Rejected revoke of %q: %v\n", reqName, err)
+		respondJSON(m, &revokeResponse{
+			responseHeader: newResponseHeader(&req.requestHeader, toAPIError(err)),
+			Name:           reqName,
+		})
+		return
+	}
+	u, err := as.revokeUser(reqName, actor, req.Reason, as.requestSource(m))
+	if err != nil {
+		respondJSON(m, &revokeResponse{
+			responseHeader: newResponseHeader(&req.requestHeader, toAPIError(err)),
+			Name:           reqName,
+		})
+		return
+	}
+	respondJSON(m, &revokeResponse{
+		responseHeader: newResponseHeader(&req.requestHeader, nil),
+		Name:           u.Name,
+		PublicKey:      u.PublicKey,
+	})
+}
+
+// revokeUser will mark the user as revoked in the registry, keep it
+// out according to our revocation mode and announce it. Actor, reason
+// and source are only recorded in the audit trail.
+//
+// The registry goes first, so renewals that race us either fail or
+// issue a JWT before the revocation, which it covers. If keeping the
+// user out fails the revocation can be asked for again.
+func (as *accessService) revokeUser(name, actor, reason, source string) (*userRecord, error) {
+	if name == "" {
+		return nil, errEmptyName
+	}
+	var wasRevoked bool
+	u, err := as.reg.Update(name, func(u *userRecord) error {
+		wasRevoked = u.Revoked
+		u.Revoked = true
+		u.RevokedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, errUnknownUser
+	}
+	if !wasRevoked {
+		as.users.add(-1)
+	}
+
+	if err := as.revoker.revoke(u.PublicKey); err != nil {
+		return nil, err
+	}
+	as.publishRevoked(u)
+	as.publishProvisioned()
+	as.audit(&auditRecord{
+		Action:    actionRevoke,
+		User:      u.Name,
+		PublicKey: u.PublicKey,
+		Role:      u.Role,
+		Expires:   u.Expires,
+		Actor:     actor,
+		Reason:    reason,
+		Source:    source,
+	})
+	return u, nil
+}
+
+// provisionedJSON is what we hand to the admin UI.
+func (as *accessService) provisionedJSON() ([]byte, error) {
+	m, err := provisioned(as.reg)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+// Tell admin that the provisioned users have changed.
+func (as *accessService) publishProvisioned() {
+	data, err := as.provisionedJSON()
+	if err != nil {
+		log.Println("Error: ", err)
+		return
+	}
+	as.nc.Publish(provUpdatesSubj, data)
+}
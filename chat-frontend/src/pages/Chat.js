@@ -26,6 +26,8 @@ const msgsPrefix = 'chat.KUBECON';
 const postsPrefix = `${msgsPrefix}.posts`;
 const dmsPrefix = `${msgsPrefix}.dms`;
 const onlineStatus = `${msgsPrefix}.online`;
+const revokedStatus = `${msgsPrefix}.revoked`;
+const revokedListSubject = 'chat.req.revoked';
 const chanGeneral = 'General';
 const chanNats = 'NATS';
 const chanKubecon = 'KUBECON';
@@ -252,6 +254,7 @@ class Chat extends React.Component {
         [chanNats]: [],
       },
       online: {},
+      revoked: {},
       intervalId: null,
     };
 
@@ -266,6 +269,9 @@ class Chat extends React.Component {
     this.changeContext = this.changeContext.bind(this);
     this.handleOnline = this.handleOnline.bind(this);
     this.handleSelfMessages = this.handleSelfMessages.bind(this);
+    this.handleRevoked = this.handleRevoked.bind(this);
+    this.addRevoked = this.addRevoked.bind(this);
+    this.verifyAccountJwt = this.verifyAccountJwt.bind(this);
     this.getOnlineJwt = this.getOnlineJwt.bind(this);
     this.logout = this.logout.bind(this);
     this.parseUserInfo = this.parseUserInfo.bind(this);
@@ -274,7 +280,7 @@ class Chat extends React.Component {
   }
 
   parseUserInfo(creds) {
-    const user = {name: '', creds: '', seed: '', publicKey: ''};
+    const user = {name: '', creds: '', seed: '', jwt: '', publicKey: '', issuer: '', issuerAccount: ''};
     if (!creds) {
       return user;
     }
@@ -291,8 +297,11 @@ class Chat extends React.Component {
 
       if (lines[i].startsWith('-----BEGIN NATS USER JWT')) {
         const jwt = decodeJwt(lines[i+1]);
+        user.jwt = lines[i+1];
         user.publicKey = jwt.sub;
         user.name = jwt.name;
+        user.issuer = jwt.iss;
+        user.issuerAccount = jwt.nats && jwt.nats.issuer_account;
       }
     }
 
@@ -327,6 +336,19 @@ class Chat extends React.Component {
       nc.subscribe(`${dmsPrefix}.${this.user.publicKey}`, {
         callback: this.handleSelfMessages,
       });
+      // Listen for users that get revoked.
+      nc.subscribe(revokedStatus, {
+        callback: this.handleRevoked,
+      });
+      // Load the users that were revoked before we got here.
+      nc.request(revokedListSubject, sc.encode('')).then((msg) => {
+        const jwt = this.verifyAccountJwt(sc.decode(msg.data));
+        if (jwt && jwt.nats.revoked) {
+          this.addRevoked(jwt.nats.revoked);
+        }
+      }).catch((err) => {
+        console.error('failed to load revoked users:', err);
+      });
 
 
       // Broadcast my heartbeats to everyone else.
@@ -380,6 +402,8 @@ class Chat extends React.Component {
       nats: {
         type: 'chat-online',
         version: 2,
+        // Lets others check we were issued by the CHAT account.
+        jwt: this.user.jwt,
       },
     });
   }
@@ -392,6 +416,11 @@ class Chat extends React.Component {
 
   updateMessages(context, msg) {
     this.setState(prev => {
+      // Drop anything from revoked users, and read receipts.
+      if (prev.revoked[msg.iss] || msg.nats.type === 'chat-read') {
+        return null;
+      }
+
       let newMessages = [];
       if (prev.messages[context]) {
         newMessages = prev.messages[context].map(m => {
@@ -399,15 +428,30 @@ class Chat extends React.Component {
         });
       }
 
-      newMessages = [
-        {
-          id: msg.jti,
-          username: msg.name,
-          time: timeFromUnix(msg.iat),
-          text: msg.nats.msg,
-        },
-        ...newMessages,
-      ];
+      // Edits and deletes refer to a post by its JTI, we only take
+      // them from its author.
+      const type = msg.nats.type;
+      if (type === 'chat-edit' || type === 'chat-delete') {
+        newMessages = newMessages.filter(m => {
+          return !(m.id === msg.nats.ref && m.iss === msg.iss && type === 'chat-delete');
+        }).map(m => {
+          if (m.id === msg.nats.ref && m.iss === msg.iss) {
+            m.text = msg.nats.msg + ' (edited)';
+          }
+          return m;
+        });
+      } else {
+        newMessages = [
+          {
+            id: msg.jti,
+            iss: msg.iss,
+            username: msg.name,
+            time: timeFromUnix(msg.iat),
+            text: msg.nats.msg,
+          },
+          ...newMessages,
+        ];
+      }
 
       const messages = Object.assign({}, prev.messages);
       messages[context] = newMessages;
@@ -541,6 +585,10 @@ class Chat extends React.Component {
     const jwt = decodeVerifyJwt(sc.decode(msg.data));
 
     this.setState(prev => {
+      if (prev.revoked[jwt.iss]) {
+        return null;
+      }
+
       let online = {};
       for (let pubKey in prev.online) {
         if (prev.online[pubKey].expiresAt < (new Date())) {
@@ -562,6 +610,46 @@ class Chat extends React.Component {
     });
   }
 
+  // Revocations are only trusted when signed by the same account key that
+  // signed our own user JWT.
+  verifyAccountJwt(tok) {
+    const jwt = decodeVerifyJwt(tok);
+    if (jwt.iss !== this.user.issuer && jwt.iss !== this.user.issuerAccount) {
+      console.error('ignoring claim not signed by our account:', jwt.iss);
+      return null;
+    }
+    return jwt;
+  }
+
+  addRevoked(publicKeys) {
+    this.setState(prev => {
+      const revoked = Object.assign({}, prev.revoked);
+      const online = Object.assign({}, prev.online);
+      for (const pubKey of publicKeys) {
+        revoked[pubKey] = true;
+        delete online[pubKey];
+      }
+      return {revoked, online};
+    });
+
+    // nc.closed will take us back to the Welcome page.
+    if (publicKeys.includes(this.user.publicKey) && this.state.nc) {
+      this.state.nc.close();
+    }
+  }
+
+  handleRevoked(err, msg) {
+    if (err) {
+      console.error("failed to receive revocation:", err);
+      return;
+    }
+
+    const jwt = this.verifyAccountJwt(sc.decode(msg.data));
+    if (jwt) {
+      this.addRevoked([jwt.sub]);
+    }
+  }
+
   handleSelfMessages(err, msg) {
     const jwt = decodeVerifyJwt(sc.decode(msg.data));
     this.updateMessages(jwt.name, jwt);
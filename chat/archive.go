@@ -0,0 +1,368 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/nats-io/nkeys"
+)
+
+// With -archive we keep the posts and DMs we receive and send, with
+// their edits and deletes, in a file per user named after our nkey.
+// Each line is a record sealed with AES-GCM, with a key derived from
+// our seed, so only we can read it. Records hold the signed claims,
+// which are checked again when we load them at startup.
+//
+// DMs we sent are sealed to the recipient, so we archive them signed
+// again without sealing, along with the ID they were sent with.
+//
+// The archive only grows while we run. At startup it is rewritten
+// with just what we kept when it holds many more records than that.
+
+const (
+	archiveContext = "natschat archive v1"
+	// Longest record we read back, a claim is much smaller.
+	maxArchiveRecord = 1024 * 1024
+)
+
+type archive struct {
+	file   string
+	f      *os.File
+	aead   cipher.AEAD
+	loaded []*archived
+}
+
+// archived is a record, place is the channel or the other user's nkey.
+type archived struct {
+	Kind  pkind  `json:"kind"`
+	Place string `json:"place"`
+	Name  string `json:"name,omitempty"`
+	JWT   string `json:"jwt"`
+	ID    string `json:"id,omitempty"`
+}
+
+// archiveKey derives the archive key from our seed.
+func archiveKey(kp nkeys.KeyPair) ([]byte, error) {
+	seed, err := kp.Seed()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range seed {
+			seed[i] = 'x'
+		}
+	}()
+	mac := hmac.New(sha256.New, seed)
+	mac.Write([]byte(archiveContext))
+	return mac.Sum(nil), nil
+}
+
+// openArchive reads our archive in dir, and opens it for new records.
+// Lock should not be held.
+func (s *state) openArchive(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	key, err := archiveKey(s.skp)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	a := &archive{file: filepath.Join(dir, s.me.Subject+".archive"), aead: aead}
+	if err := a.read(); err != nil {
+		return err
+	}
+	if a.f, err = os.OpenFile(a.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return err
+	}
+	s.archive = a
+	return nil
+}
+
+// read loads the records, skipping those we can not open.
+func (a *archive) read() error {
+	f, err := os.Open(a.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxArchiveRecord)
+	for scanner.Scan() {
+		if rec, err := a.open(scanner.Text()); err == nil {
+			a.loaded = append(a.loaded, rec)
+		}
+	}
+	return scanner.Err()
+}
+
+func (a *archive) open(line string) (*archived, error) {
+	sealed, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return nil, err
+	}
+	ns := a.aead.NonceSize()
+	if len(sealed) < ns {
+		return nil, errors.New("archive record is too short")
+	}
+	data, err := a.aead.Open(nil, sealed[:ns], sealed[ns:], nil)
+	if err != nil {
+		return nil, err
+	}
+	rec := &archived{}
+	return rec, json.Unmarshal(data, rec)
+}
+
+func (a *archive) seal(rec *archived) ([]byte, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, a.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := a.aead.Seal(nonce, nonce, data, nil)
+	return append([]byte(base64.StdEncoding.EncodeToString(sealed)), '\n'), nil
+}
+
+func (a *archive) write(rec *archived) error {
+	line, err := a.seal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = a.f.Write(line)
+	return err
+}
+
+// rewrite replaces the archive with just recs.
+func (a *archive) rewrite(recs []*archived) error {
+	tmp := a.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, rec := range recs {
+		line, err := a.seal(rec)
+		if err == nil {
+			_, err = w.Write(line)
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, a.file); err != nil {
+		return err
+	}
+	a.f.Close()
+	a.f, err = os.OpenFile(a.file, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// archivePosts records posts or changes for a channel, or the user
+// with nkey place. Our own DMs need to be unsealed, see ownDM.
+// Assume lock is held.
+func (s *state) archivePosts(kind pkind, place string, posts []*postClaim) {
+	if s.archive == nil {
+		return
+	}
+	for _, p := range posts {
+		rec := &archived{Kind: kind, Place: place, JWT: p.raw}
+		if kind == direct {
+			if u := s.users[place]; u != nil {
+				rec.Name = u.nick
+			}
+			if p.Issuer == s.me.Subject {
+				rec.ID = p.ID
+			}
+		}
+		if rec.JWT == "" {
+			continue
+		}
+		if err := s.archive.write(rec); err != nil {
+			s.logErr("-ERR Could not archive post: %v", err)
+		}
+	}
+}
+
+// ownDM signs a DM we send again without sealing it, so we can read it
+// from the archive. Assume lock is held.
+func (s *state) ownDM(p *postClaim) string {
+	if s.archive == nil {
+		return ""
+	}
+	claim := *p.GenericClaims
+	ojwt, err := claim.Encode(s.skp)
+	if err != nil {
+		return ""
+	}
+	return ojwt
+}
+
+// loadArchive puts what we archived back into the channels and DMs,
+// checking every claim again. Users we only know from the archive are
+// added under the name they had. Lock should not be held.
+func (s *state) loadArchive() {
+	if s.archive == nil {
+		return
+	}
+	type where struct {
+		kind pkind
+		name string
+	}
+	type place struct {
+		where
+		user          string
+		posts, change []*postClaim
+	}
+	places := make(map[where]*place)
+	recs := make(map[string]*archived)
+
+	for _, rec := range s.archive.loaded {
+		check := s.checkPostClaim
+		if rec.Kind == direct {
+			check = s.checkDMClaim
+		}
+		p := check(rec.JWT)
+		if p == nil {
+			continue
+		}
+		p.raw = rec.JWT
+		if rec.ID != "" && p.Issuer == s.me.Subject {
+			p.ID, p.sealed = rec.ID, true
+		}
+		w := where{rec.Kind, rec.Place}
+		pl := places[w]
+		if pl == nil {
+			pl = &place{where: w}
+			places[w] = pl
+		}
+		if rec.Name != "" {
+			pl.user = rec.Name
+		} else if p.Issuer == rec.Place && pl.user == "" {
+			pl.user = p.Name
+		}
+		if isChange(p) {
+			pl.change = append(pl.change, p)
+		} else {
+			pl.posts = append(pl.posts, p)
+		}
+		recs[p.ID] = rec
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var kept []*archived
+	for _, pl := range places {
+		var r *postRing
+		switch pl.kind {
+		case channel:
+			s.addChannel(pl.name)
+			r = s.posts[pl.name]
+		case direct:
+			if pl.name == s.me.Subject || !nkeys.IsValidPublicUserKey(pl.name) {
+				continue
+			}
+			u := s.users[pl.name]
+			if u == nil && pl.user == "" {
+				continue
+			}
+			if u == nil {
+				u = s.addNewUser(pl.user, pl.name)
+			}
+			r = u.posts
+		}
+		if r == nil {
+			continue
+		}
+		var posts, changes []*postClaim
+		for _, p := range pl.posts {
+			if !s.isRevoked(p.Issuer) && !s.postIsDupe(p) {
+				posts = append(posts, p)
+			}
+		}
+		for _, c := range pl.change {
+			if !s.isRevoked(c.Issuer) && !s.postIsDupe(c) {
+				changes = append(changes, c)
+			}
+		}
+		s.recordChanges(r, changes)
+		r.merge(s.applyChanges(posts))
+		s.indexPosts(pl.kind, pl.name, r.all())
+
+		for _, p := range r.all() {
+			if rec := recs[p.ID]; rec != nil {
+				kept = append(kept, rec)
+			}
+			for _, c := range s.changes[p.ID] {
+				if rec := recs[c.ID]; rec != nil {
+					kept = append(kept, rec)
+				}
+			}
+		}
+	}
+
+	if len(s.archive.loaded) > 2*len(kept)+s.maxPosts {
+		if err := s.archive.rewrite(kept); err != nil {
+			log.Printf("Could not compact the archive: %v", err)
+		}
+	}
+	s.archive.loaded = nil
+}
+
+// Lock should not be held.
+func (s *state) closeArchive() {
+	s.Lock()
+	defer s.Unlock()
+	if s.archive != nil {
+		s.archive.f.Close()
+		s.archive = nil
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/marcusolsson/tui-go"
+	jwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+)
+
+// The channel directory. Everything on it is a claim signed by the
+// user sending it, of one of these types:
+//
+// chat-channel announces a new channel, the subject is its name.
+// chat-channels-query is sent when we start to ask others what they know.
+// chat-channels answers a query with all channels known to the sender.
+const channelsSub = preSub + "channels"
+
+const (
+	maxChannels      = 64
+	maxDirectoryWait = time.Second
+)
+
+// Channel names end up as a subject token.
+var channelNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,16}$`)
+
+// Fixed channels everyone starts with.
+var defaultChannels = []string{"KUBECON", "NATS", "General"}
+
+// Assume lock is held.
+func (s *state) hasChannel(name string) bool {
+	_, ok := s.posts[name]
+	return ok
+}
+
+// addChannel will add a channel we have not seen before, and returns
+// if it did. The sidebar is always updated through the UI queue so it
+// stays in the same order as chOrder. Assume lock is held.
+func (s *state) addChannel(name string) bool {
+	if s.hasChannel(name) || !channelNameRe.MatchString(name) || len(s.chOrder) >= maxChannels {
+		return false
+	}
+	s.posts[name] = newPostRing(s.maxPosts)
+	s.chOrder = append(s.chOrder, name)
+	if s.ui != nil {
+		s.queueUpdate(s.refreshChannels)
+	}
+	return true
+}
+
+// Assume lock is held.
+func (s *state) channelNames() []string {
+	return append([]string(nil), s.chOrder...)
+}
+
+func (s *state) newChannelClaim(kind, subject string) *jwt.GenericClaims {
+	claim := jwt.NewGenericClaims(subject)
+	claim.Name = s.name
+	claim.Data["type"] = kind
+	return claim
+}
+
+// Lock should be held.
+func (s *state) publishChannelClaim(claim *jwt.GenericClaims) error {
+	cjwt, err := claim.Encode(s.skp)
+	if err != nil {
+		return err
+	}
+	return s.nc.Publish(channelsSub, []byte(cjwt))
+}
+
+// Ask everyone else which channels exist.
+func (s *state) queryChannels() {
+	s.Lock()
+	defer s.Unlock()
+	s.publishChannelClaim(s.newChannelClaim("chat-channels-query", s.me.Subject))
+}
+
+func init() {
+	registerCommand(&command{
+		name: "/create",
+		args: "<channel>",
+		help: "Start a new channel and switch to it",
+		min:  1, max: 1,
+		run: func(s *state, args []string) error {
+			return s.createChannel(args[0])
+		},
+		complete: noCompletion,
+	})
+	registerCommand(&command{
+		name: "/join",
+		args: "<channel>",
+		help: "Switch to a channel",
+		min:  1, max: 1,
+		run: func(s *state, args []string) error {
+			return s.joinChannel(args[0])
+		},
+		complete: (*state).channelNames,
+	})
+}
+
+// /create announces a new channel and switches to it.
+// Lock should be held.
+func (s *state) createChannel(name string) error {
+	if !channelNameRe.MatchString(name) {
+		return fmt.Errorf("Channel names are up to 16 letters, digits, - or _, not %q", name)
+	}
+	if s.addChannel(name) {
+		if err := s.publishChannelClaim(s.newChannelClaim("chat-channel", name)); err != nil {
+			s.notice(fmt.Sprintf("Could not announce %q: %v", name, err))
+		}
+	} else if !s.hasChannel(name) {
+		return fmt.Errorf("Too many channels, can not create %q", name)
+	}
+	s.selectChannel(name)
+	return nil
+}
+
+// /join switches to a channel in the directory.
+// Lock should be held.
+func (s *state) joinChannel(name string) error {
+	if !s.hasChannel(name) {
+		return fmt.Errorf("No channel %q, use /create to start it", name)
+	}
+	s.selectChannel(name)
+	return nil
+}
+
+// selectChannel is queued behind any pending sidebar updates.
+// Lock should be held.
+func (s *state) selectChannel(name string) {
+	for i, n := range s.chOrder {
+		if n == name {
+			s.queueUpdate(func() {
+				s.Lock()
+				defer s.Unlock()
+				s.channels.SetSelected(i)
+				s.setPostsDisplay(s.chSel())
+			})
+			return
+		}
+	}
+}
+
+// Receive channel announcements, queries and directories.
+func (s *state) processChannels(m *nats.Msg) {
+	claim, err := jwt.DecodeGeneric(string(m.Data))
+	if err != nil {
+		s.logErr("-ERR Received a bad channel claim: %v", err)
+		return
+	}
+	vr := jwt.CreateValidationResults()
+	claim.Validate(vr)
+	if vr.IsBlocking(true) {
+		s.logErr("-ERR Blocking issues for channel claim:%+v", vr)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// Channels from unverified users are dropped like their posts, so
+	// they can not fill the sidebar of everyone else.
+	if claim.Issuer == s.me.Subject || !s.acceptFrom(claim.Issuer) {
+		return
+	}
+	kind, _ := claim.Data["type"].(string)
+	switch kind {
+	case "chat-channel":
+		s.addChannel(claim.Subject)
+	case "chat-channels":
+		names, _ := claim.Data["channels"].([]interface{})
+		theirs := make(map[string]bool, len(names))
+		for _, n := range names {
+			if name, ok := n.(string); ok {
+				theirs[name] = true
+				s.addChannel(name)
+			}
+		}
+		// No need to answer a query ourselves if they know all we know.
+		for _, name := range s.chOrder {
+			if !theirs[name] {
+				return
+			}
+		}
+		s.lastDirectory = time.Now()
+	case "chat-channels-query":
+		// Everyone hears the query, so wait a bit and only answer
+		// if nobody else has answered before us.
+		if s.hasOnlyDefaultChannels() {
+			return
+		}
+		wait := time.Duration(rand.Int63n(int64(maxDirectoryWait)))
+		asked := time.Now()
+		time.AfterFunc(wait, func() { s.answerChannelsQuery(asked) })
+	}
+}
+
+// Assume lock is held.
+func (s *state) hasOnlyDefaultChannels() bool {
+	return len(s.chOrder) == len(defaultChannels)
+}
+
+func (s *state) answerChannelsQuery(asked time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	if s.lastDirectory.After(asked) {
+		return
+	}
+	names := s.channelNames()
+	sort.Strings(names)
+	claim := s.newChannelClaim("chat-channels", s.me.Subject)
+	claim.Data["channels"] = names
+	s.publishChannelClaim(claim)
+	s.lastDirectory = time.Now()
+}
+
+// Lock should be held.
+func (s *state) notice(msg string) {
+	label := tui.NewLabel(strings.TrimSpace(msg))
+	label.SetWordWrap(true)
+	s.rows++
+	s.msgs.AppendRow(tui.NewHBox(
+		tui.NewLabel(time.Now().Format("15:04")),
+		tui.NewPadder(1, 0, tui.NewLabel(postUser("*"))),
+		label,
+		tui.NewSpacer(),
+	))
+}
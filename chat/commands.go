@@ -0,0 +1,248 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// command is something typed into the input box starting with a slash.
+// Features register theirs with registerCommand from an init func.
+type command struct {
+	name string
+	// Usage of the arguments, e.g. "<channel>", and a one line help.
+	args string
+	help string
+	// Number of arguments needed, and at most allowed. When rest is
+	// set the only argument is the rest of the line.
+	min, max int
+	rest     bool
+	// Run with the lock held, errors are shown in the message pane.
+	run func(s *state, args []string) error
+	// Candidates to complete the last argument with, users by default.
+	complete func(s *state) []string
+}
+
+var commands = make(map[string]*command)
+
+func registerCommand(c *command) {
+	commands[c.name] = c
+}
+
+func init() {
+	registerCommand(&command{
+		name: "/help",
+		help: "List the commands",
+		run: func(s *state, _ []string) error {
+			s.showHelp()
+			return nil
+		},
+		complete: noCompletion,
+	})
+	registerCommand(&command{
+		name: "/quit",
+		help: "Leave the chat",
+		run: func(s *state, _ []string) error {
+			s.ui.Quit()
+			return nil
+		},
+		complete: noCompletion,
+	})
+	registerCommand(&command{
+		name: "/dm",
+		args: "<user>",
+		help: "Switch to direct messages with a user",
+		min:  1, max: 1,
+		run: func(s *state, args []string) error {
+			return s.selectDirect(args[0])
+		},
+	})
+	registerCommand(&command{
+		name: "/nick",
+		args: "<name>",
+		help: "Change the name others see",
+		min:  1, max: 1,
+		run: func(s *state, args []string) error {
+			return s.setNick(args[0])
+		},
+		complete: noCompletion,
+	})
+	registerCommand(&command{
+		name: "/me",
+		args: "<action>",
+		help: "Post an action, e.g. /me waves",
+		min:  1, max: 1, rest: true,
+		run: func(s *state, args []string) error {
+			p := s.newPost(args[0])
+			p.Data["action"] = true
+			return s.post(p)
+		},
+	})
+}
+
+func noCompletion(*state) []string {
+	return nil
+}
+
+// parseCommand splits a line into its command and arguments.
+func parseCommand(line string) (*command, []string, error) {
+	fields := strings.Fields(line)
+	c := commands[fields[0]]
+	if c == nil {
+		return nil, nil, fmt.Errorf("Unknown command %s, try /help", fields[0])
+	}
+	args := fields[1:]
+	if c.rest && len(args) > 0 {
+		args = []string{strings.TrimSpace(strings.TrimSpace(line)[len(c.name):])}
+	}
+	if len(args) < c.min || len(args) > c.max {
+		return nil, nil, c.usage()
+	}
+	return c, args, nil
+}
+
+func (c *command) usage() error {
+	return errors.New(strings.TrimSpace("Usage: " + c.name + " " + c.args))
+}
+
+// runCommand handles input starting with a slash. Lock should be held.
+func (s *state) runCommand(line string) {
+	c, args, err := parseCommand(line)
+	if err == nil {
+		err = c.run(s, args)
+	}
+	if err != nil {
+		s.notice(err.Error())
+	}
+}
+
+// Lock should be held.
+func (s *state) showHelp() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := commands[name]
+		s.notice(fmt.Sprintf("%s %s - %s", c.name, c.args, c.help))
+	}
+}
+
+// completeCommand completes the command name, or its last argument,
+// for TAB. With several candidates we complete what they have in
+// common and list them. Lock should be held.
+func (s *state) completeCommand(line string) string {
+	fields := strings.Fields(line)
+	word := ""
+	if !strings.HasSuffix(line, " ") {
+		word = fields[len(fields)-1]
+	}
+
+	var candidates []string
+	if len(fields) == 1 && word != "" {
+		for name := range commands {
+			candidates = append(candidates, name)
+		}
+	} else if c := commands[fields[0]]; c != nil && c.complete != nil {
+		candidates = c.complete(s)
+	} else {
+		candidates = s.userNames()
+	}
+
+	var matches []string
+	for _, cand := range candidates {
+		if strings.HasPrefix(cand, word) {
+			matches = append(matches, cand)
+		}
+	}
+	if len(matches) == 0 {
+		return line
+	}
+	sort.Strings(matches)
+	prefix := line[:len(line)-len(word)]
+	if len(matches) == 1 {
+		return prefix + matches[0] + " "
+	}
+	s.notice(strings.Join(matches, " "))
+	return prefix + commonPrefix(matches)
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// Lock should be held.
+func (s *state) userNames() []string {
+	names := make([]string, 0, len(s.dms))
+	for name := range s.dms {
+		names = append(names, name)
+	}
+	return names
+}
+
+// /dm switches to the DM with a user. Selecting it in the list does
+// the rest. Lock should be held.
+func (s *state) selectDirect(name string) error {
+	u := s.dms[name]
+	if u == nil {
+		return fmt.Errorf("No user %q, try /who", name)
+	}
+	s.queueUpdate(func() {
+		s.Lock()
+		index := -1
+		for i, du := range s.userListSorted() {
+			if du == u {
+				index = i
+			}
+		}
+		s.Unlock()
+		if index >= 0 {
+			s.direct.Select(index)
+		}
+	})
+	return nil
+}
+
+// /nick changes our name, which others pick up from our next online
+// status. Lock should be held.
+func (s *state) setNick(nick string) error {
+	name := displayName(nick)
+	me := s.users[s.me.Subject]
+	if other := s.dms[name]; other != nil && other != me {
+		return fmt.Errorf("%q is taken", name)
+	}
+	if me != nil {
+		if s.cur != nil && s.cur.kind == direct && s.cur.name == me.name {
+			s.cur.name = name
+		}
+		delete(s.dms, me.name)
+		me.name, me.nick = name, name
+		s.dms[name] = me
+	}
+	s.name = name
+	go s.sendOnlineStatus(false)
+	s.queueUpdate(s.refreshDirect)
+	s.notice("You are now " + name)
+	return nil
+}
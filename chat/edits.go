@@ -0,0 +1,255 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+
+	jwt "github.com/nats-io/jwt/v2"
+)
+
+// Posts are never changed once sent. An edit or delete is a new claim,
+// signed like any post and sent on the same subject, carrying the JTI
+// of the post it changes as ref. Only the author of a post may change
+// it, and moderators may change channel posts. Moderators are users
+// chat-access issued with the moderator role.
+//
+// Changes may arrive before the post they refer to, from history or
+// late, so we remember them and apply them once the post arrives.
+// Deleted posts are removed, edited ones are shown marked.
+
+const (
+	editType   = "chat-edit"
+	deleteType = "chat-delete"
+
+	// Tag chat-access puts on users an admin provisioned as moderators.
+	moderatorTag = "role:moderator"
+	// Edited posts are shown with this after them.
+	editedMark = " (edited)"
+	// Posts we remember changes for at most, for posts we may load
+	// later, and changes remembered per post.
+	maxChanges        = 10000
+	maxChangesPerPost = 20
+)
+
+func init() {
+	registerCommand(&command{
+		name: "/edit",
+		args: "<message>",
+		help: "Edit the picked post, or your last one",
+		min:  1, max: 1, rest: true,
+		run: func(s *state, args []string) error {
+			return s.sendChange(editType, args[0])
+		},
+		complete: noCompletion,
+	})
+	registerCommand(&command{
+		name: "/delete",
+		help: "Delete the picked post, or your last one",
+		run: func(s *state, _ []string) error {
+			return s.sendChange(deleteType, "")
+		},
+		complete: noCompletion,
+	})
+}
+
+func isChange(p *postClaim) bool {
+	t := p.Data["type"]
+	return t == editType || t == deleteType
+}
+
+func refOf(p *postClaim) string {
+	ref, _ := p.Data["ref"].(string)
+	return ref
+}
+
+// Assume lock is held.
+func (s *state) isModerator(nkey string) bool {
+	return s.moderators[nkey] && s.isVerified(nkey)
+}
+
+// mayChange tells if the user issuer may change the post p.
+// Assume lock is held.
+func (s *state) mayChange(issuer string, p *postClaim) bool {
+	if issuer == p.Issuer {
+		return true
+	}
+	return p.Data["type"] != "chat-dm" && s.isModerator(issuer)
+}
+
+// changeTarget is the post /edit and /delete act on, the picked one or
+// else our last one on display. Lock should be held.
+func (s *state) changeTarget() (*postClaim, error) {
+	if s.replyTo != nil {
+		if !s.mayChange(s.me.Subject, s.replyTo) {
+			return nil, errors.New("You can only change your own posts")
+		}
+		return s.replyTo, nil
+	}
+	for i := len(s.shown) - 1; i >= 0; i-- {
+		if p := s.shown[i].post; p.Issuer == s.me.Subject {
+			return p, nil
+		}
+	}
+	return nil, errors.New("No post to change, pick one with Ctrl+R")
+}
+
+// sendChange sends an edit or delete of the target post, and applies
+// it ourselves. Lock should be held.
+func (s *state) sendChange(kind, msg string) error {
+	target, err := s.changeTarget()
+	if err != nil {
+		return err
+	}
+	c := &postClaim{GenericClaims: jwt.NewGenericClaims(s.cur.name)}
+	c.Name = s.name
+	c.Data["type"] = kind
+	c.Data["ref"] = target.ID
+	if kind == editType {
+		c.Data["msg"] = msg
+	}
+	if err := s.publish(c); err != nil {
+		return err
+	}
+	s.setReplyTo(nil)
+	s.recordChanges(s.selPosts(s.cur), []*postClaim{c})
+	s.setPostsDisplay(s.cur)
+	return nil
+}
+
+// recordChanges remembers changes to the posts in r, and applies those
+// to posts we have. Returns if any post changed. Assume lock is held.
+func (s *state) recordChanges(r *postRing, changes []*postClaim) bool {
+	changed := false
+	for _, c := range changes {
+		ref := refOf(c)
+		if ref == "" || hasPost(s.changes[ref], c.ID) {
+			continue
+		}
+		if len(s.changes) >= maxChanges && s.changes[ref] == nil {
+			for old := range s.changes {
+				delete(s.changes, old)
+				break
+			}
+		}
+		s.changes[ref] = trimChanges(append(s.changes[ref], c))
+
+		if p := s.findPost(r, ref); p != nil && s.applyChange(c, p) {
+			if p.deleted {
+				s.removePost(r, p)
+				s.mentions.remove(p.ID)
+				s.search.remove(p.ID)
+			} else if e := s.search.entries[p.ID]; e != nil {
+				s.search.add(p, e.kind, e.name)
+			}
+			changed = true
+		}
+	}
+	return changed
+}
+
+// applyChanges applies the changes we have for posts that just arrived,
+// and drops those that were deleted. Assume lock is held.
+func (s *state) applyChanges(posts []*postClaim) []*postClaim {
+	kept := posts[:0]
+	for _, p := range posts {
+		for _, c := range s.changes[p.ID] {
+			s.applyChange(c, p)
+		}
+		if !p.deleted {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// applyChange changes p if c is allowed to, and is newer than the last
+// edit. Assume lock is held.
+func (s *state) applyChange(c, p *postClaim) bool {
+	if p.deleted || !s.mayChange(c.Issuer, p) {
+		return false
+	}
+	switch c.Data["type"] {
+	case editType:
+		if c.IssuedAt < p.edited {
+			return false
+		}
+		p.Data["msg"] = c.Data["msg"]
+		p.edited = c.IssuedAt
+	case deleteType:
+		p.deleted = true
+	}
+	return true
+}
+
+// trimChanges keeps at most maxChangesPerPost changes, dropping the
+// oldest edits first since only the latest one shows. Deletes are only
+// dropped when there is nothing else left to drop.
+func trimChanges(changes []*postClaim) []*postClaim {
+	for len(changes) > maxChangesPerPost {
+		drop := 0
+		for i, c := range changes {
+			if c.Data["type"] != editType {
+				continue
+			}
+			if d := changes[drop]; d.Data["type"] != editType || c.IssuedAt < d.IssuedAt {
+				drop = i
+			}
+		}
+		changes = append(changes[:drop], changes[drop+1:]...)
+	}
+	return changes
+}
+
+func hasPost(posts []*postClaim, id string) bool {
+	for _, p := range posts {
+		if p.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// findPost looks for a post in r, or in the scrollback when r is on
+// display. Assume lock is held.
+func (s *state) findPost(r *postRing, id string) *postClaim {
+	if r == nil {
+		return nil
+	}
+	if p := r.find(id); p != nil {
+		return p
+	}
+	if s.cur != nil && s.selPosts(s.cur) == r {
+		for _, p := range s.cur.older {
+			if p.ID == id {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// Assume lock is held.
+func (s *state) removePost(r *postRing, p *postClaim) {
+	if r.remove(p.ID) || s.cur == nil || s.selPosts(s.cur) != r {
+		return
+	}
+	older := s.cur.older[:0]
+	for _, op := range s.cur.older {
+		if op != p {
+			older = append(older, op)
+		}
+	}
+	s.cur.older = older
+}
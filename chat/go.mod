@@ -3,10 +3,13 @@ module github.com/connecteverything/oscon2019/chat
 go 1.12
 
 require (
+	github.com/connecteverything/oscon2019/creds v0.0.0
 	github.com/golang/protobuf v1.4.3 // indirect
 	github.com/marcusolsson/tui-go v0.4.0
 	github.com/nats-io/jwt/v2 v2.0.0-20201015190852-e11ce317263c
 	github.com/nats-io/nats-server/v2 v2.1.8 // indirect
-	github.com/nats-io/nats.go v1.10.0
-	github.com/nats-io/nkeys v0.2.0
+	github.com/nats-io/nats.go v1.13.0
+	github.com/nats-io/nkeys v0.4.6
 )
+
+replace github.com/connecteverything/oscon2019/creds => ../creds
@@ -0,0 +1,407 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Streams capturing posts and DMs, see the README on how to create
+// them. They should limit messages per subject, since we read all of
+// a channel to find its last messages.
+//
+// DMs are read with a consumer filtered on our own DM subject, created
+// on a subject naming that filter so the server checks it against our
+// permissions. Those can only allow our own DMs, see chat-access.
+const (
+	postsStream = "CHAT_POSTS"
+	dmsStream   = "CHAT_DMS"
+	dmsCreate   = "$JS.API.CONSUMER.CREATE." + dmsStream + ".%s.%s"
+
+	// How long we wait for the next message of a replay.
+	historyWait = 2 * time.Second
+)
+
+// loadHistory replays all channels we know and our DMs. Channels we
+// learn about later are replayed when first selected.
+func (s *state) loadHistory() {
+	s.Lock()
+	names := s.channelNames()
+	s.Unlock()
+
+	for _, name := range names {
+		s.loadChannelHistory(name)
+	}
+	s.loadDMHistory()
+}
+
+func (s *state) loadChannelHistory(name string) {
+	s.Lock()
+	if s.js == nil || s.loaded[name] {
+		s.Unlock()
+		return
+	}
+	s.loaded[name] = true
+	s.Unlock()
+
+	posts, err := s.replay(postsStream, fmt.Sprintf(postsPub, name), s.histLast, nil)
+
+	s.Lock()
+	defer s.Unlock()
+	if err != nil {
+		s.logErr("-ERR Could not load history for %q: %v", name, err)
+		return
+	}
+	r := s.posts[name]
+	fresh, changes := s.freshPosts(posts)
+	s.archivePosts(channel, name, append(append([]*postClaim(nil), fresh...), changes...))
+	changed := s.recordChanges(r, changes)
+	fresh = s.applyChanges(fresh)
+	if len(fresh) == 0 && !changed {
+		return
+	}
+	r.merge(fresh)
+	s.indexPosts(channel, name, fresh)
+	if s.cur != nil && s.cur.kind == channel && s.cur.name == name {
+		s.refreshDisplay()
+	}
+}
+
+// loadDMHistory replays the DMs sent to us. Users we do not know yet
+// are added, they may just not be online right now.
+func (s *state) loadDMHistory() {
+	s.Lock()
+	if s.js == nil {
+		s.Unlock()
+		return
+	}
+	s.Unlock()
+
+	posts, err := s.replayDMs(s.histLast, nil)
+
+	s.Lock()
+	defer s.Unlock()
+	if err != nil {
+		s.logErr("-ERR Could not load DM history: %v", err)
+		return
+	}
+	fresh, changes := s.freshPosts(posts)
+	byUser := make(map[string][]*postClaim)
+	for _, p := range fresh {
+		byUser[p.Issuer] = append(byUser[p.Issuer], p)
+	}
+	// DMs can only be changed by who sent them.
+	for _, c := range changes {
+		var r *postRing
+		if u := s.users[c.Issuer]; u != nil {
+			r = u.posts
+			s.archivePosts(direct, u.nkey, []*postClaim{c})
+		}
+		if s.recordChanges(r, []*postClaim{c}) && s.cur != nil && s.cur.kind == direct && s.cur.name == s.users[c.Issuer].name {
+			s.refreshDisplay()
+		}
+	}
+	for nkey, fresh := range byUser {
+		if fresh = s.applyChanges(fresh); len(fresh) == 0 {
+			continue
+		}
+		u := s.users[nkey]
+		if u == nil {
+			u = s.addNewUser(fresh[0].Name, nkey)
+			s.queueUpdate(s.refreshDirect)
+		}
+		u.posts.merge(fresh)
+		s.indexPosts(direct, nkey, fresh)
+		s.archivePosts(direct, nkey, fresh)
+		if s.cur != nil && s.cur.kind == direct && s.cur.name == u.name {
+			s.refreshDisplay()
+		}
+	}
+}
+
+// replay reads the last posts on subject from stream with an ordered
+// consumer, starting at our history window. When keep is set it picks
+// the posts we want, and can stop the replay early.
+func (s *state) replay(stream, subject string, last int, keep func(p *postClaim) (ok, more bool)) ([]*postClaim, error) {
+	opts := []nats.SubOpt{nats.BindStream(stream), nats.OrderedConsumer()}
+	if s.histWindow > 0 && keep == nil {
+		opts = append(opts, nats.StartTime(time.Now().Add(-s.histWindow)))
+	} else {
+		opts = append(opts, nats.DeliverAll())
+	}
+	sub, err := s.js.SubscribeSync(subject, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+	return s.readReplay(sub, s.checkPostClaim, last, keep)
+}
+
+// dmConsumer is the consumer we create on the DM stream. The consumer
+// config of our client does not know about names or inactive
+// thresholds yet.
+type dmConsumer struct {
+	Name string `json:"name"`
+	nats.ConsumerConfig
+	InactiveThreshold time.Duration `json:"inactive_threshold"`
+}
+
+type dmConsumerRequest struct {
+	Stream string      `json:"stream_name"`
+	Config *dmConsumer `json:"config"`
+}
+
+type dmConsumerResponse struct {
+	Error *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error,omitempty"`
+}
+
+// replayDMs is replay for the DMs sent to us, with a consumer of our
+// own that goes away once we stop listening.
+func (s *state) replayDMs(last int, keep func(p *postClaim) (ok, more bool)) ([]*postClaim, error) {
+	s.Lock()
+	nc, subject := s.nc, fmt.Sprintf(dmsPub, s.me.Subject)
+	s.Unlock()
+
+	inbox := nats.NewInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	// Inboxes are unique, their last token makes a unique name.
+	name := inbox[len(nats.InboxPrefix):]
+	cfg := &dmConsumer{
+		Name: name,
+		ConsumerConfig: nats.ConsumerConfig{
+			DeliverSubject: inbox,
+			DeliverPolicy:  nats.DeliverAllPolicy,
+			AckPolicy:      nats.AckNonePolicy,
+			FilterSubject:  subject,
+			ReplayPolicy:   nats.ReplayInstantPolicy,
+		},
+		InactiveThreshold: historyWait,
+	}
+	if s.histWindow > 0 && keep == nil {
+		start := time.Now().Add(-s.histWindow)
+		cfg.DeliverPolicy, cfg.OptStartTime = nats.DeliverByStartTimePolicy, &start
+	}
+	req, err := json.Marshal(&dmConsumerRequest{Stream: dmsStream, Config: cfg})
+	if err != nil {
+		return nil, err
+	}
+	m, err := nc.Request(fmt.Sprintf(dmsCreate, name, subject), req, historyWait)
+	if err != nil {
+		return nil, err
+	}
+	var resp dmConsumerResponse
+	if err := json.Unmarshal(m.Data, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("%s (%d)", resp.Error.Description, resp.Error.Code)
+	}
+	return s.readReplay(sub, s.checkDMClaim, last, keep)
+}
+
+// readReplay reads what a consumer delivers on sub until it has nothing
+// pending, keeping the last posts.
+func (s *state) readReplay(sub *nats.Subscription, check func(string) *postClaim, last int, keep func(p *postClaim) (ok, more bool)) ([]*postClaim, error) {
+	var posts []*postClaim
+	for {
+		m, err := sub.NextMsg(historyWait)
+		if err == nats.ErrTimeout {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p := check(string(m.Data)); p != nil {
+			ok, more := true, true
+			if keep != nil {
+				ok, more = keep(p)
+			}
+			if ok {
+				posts = append(posts, p)
+				if len(posts) > last {
+					posts = posts[1:]
+				}
+			}
+			if !more {
+				break
+			}
+		}
+		if meta, err := m.Metadata(); err != nil || meta.NumPending == 0 {
+			break
+		}
+	}
+	return posts, nil
+}
+
+// freshPosts drops posts we already have or would not accept, and
+// splits off edits and deletes. Read receipts are recorded.
+// Lock should be held.
+func (s *state) freshPosts(posts []*postClaim) (fresh, changes []*postClaim) {
+	for _, p := range posts {
+		if !s.acceptPost(p) || s.postIsDupe(p) {
+			continue
+		}
+		if isReceipt(p) {
+			s.recordReceipt(p)
+		} else if isChange(p) {
+			changes = append(changes, p)
+		} else {
+			fresh = append(fresh, p)
+		}
+	}
+	return fresh, changes
+}
+
+func init() {
+	registerCommand(&command{
+		name: "/older",
+		help: "Load older posts from history",
+		run: func(s *state, _ []string) error {
+			return s.loadOlder()
+		},
+		complete: noCompletion,
+	})
+}
+
+// /older loads the posts from history sent before those on display.
+// Lock should be held.
+func (s *state) loadOlder() error {
+	if s.js == nil {
+		return errors.New("Message history is not available")
+	}
+	if s.cur.kind == mentions {
+		return errors.New("Use /older in the channel of the post")
+	}
+	if len(s.cur.older) >= s.maxPosts {
+		return errors.New("Scrollback is full, switch away and back to reset it")
+	}
+	go s.replayOlder(s.cur)
+	return nil
+}
+
+func (s *state) replayOlder(sel *selection) {
+	s.Lock()
+	r := s.selPosts(sel)
+	if r == nil {
+		s.Unlock()
+		return
+	}
+	var issuer string
+	if sel.kind == direct {
+		issuer = s.dms[sel.name].nkey
+	}
+	shown := make(map[string]bool)
+	for _, p := range append(r.all(), sel.older...) {
+		shown[p.ID] = true
+	}
+	oldest := r.first()
+	if len(sel.older) > 0 {
+		oldest = sel.older[0]
+	}
+	s.Unlock()
+
+	// Our own DMs are not sent to us, so we may not find the oldest
+	// post and fall back to when it was sent.
+	keep := func(p *postClaim) (bool, bool) {
+		if oldest != nil && p.ID == oldest.ID {
+			return false, false
+		}
+		if issuer != "" && p.Issuer != issuer {
+			return false, true
+		}
+		if isChange(p) {
+			return true, true
+		}
+		if oldest != nil && p.IssuedAt > oldest.IssuedAt {
+			return false, true
+		}
+		return !shown[p.ID], true
+	}
+	var posts []*postClaim
+	var err error
+	if sel.kind == direct {
+		posts, err = s.replayDMs(s.histLast, keep)
+	} else {
+		posts, err = s.replay(postsStream, fmt.Sprintf(postsPub, sel.name), s.histLast, keep)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.cur != sel {
+		return
+	}
+	if err != nil {
+		s.queueNotice(fmt.Sprintf("Could not load older posts: %v", err))
+		return
+	}
+	var older, changes []*postClaim
+	for _, p := range posts {
+		switch {
+		case !s.acceptPost(p):
+		case isReceipt(p):
+			s.recordReceipt(p)
+		case isChange(p):
+			changes = append(changes, p)
+		default:
+			older = append(older, p)
+		}
+	}
+	s.recordChanges(r, changes)
+	older = s.applyChanges(older)
+	if len(older) == 0 {
+		s.queueNotice("No older posts in history")
+		return
+	}
+	if room := s.maxPosts - len(sel.older); len(older) > room {
+		older = older[len(older)-room:]
+	}
+	if sel.kind == direct {
+		s.indexPosts(direct, issuer, older)
+	} else {
+		s.indexPosts(channel, sel.name, older)
+	}
+	sel.older = append(older, sel.older...)
+	s.refreshDisplay()
+}
+
+// Lock should be held.
+func (s *state) queueNotice(msg string) {
+	s.queueUpdate(func() {
+		s.Lock()
+		defer s.Unlock()
+		s.notice(msg)
+	})
+}
+
+// Lock should be held.
+func (s *state) refreshDisplay() {
+	s.queueUpdate(func() {
+		s.Lock()
+		defer s.Unlock()
+		s.setPostsDisplay(s.cur)
+	})
+}
@@ -14,16 +14,19 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"log"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/connecteverything/oscon2019/creds"
 	"github.com/nats-io/nats.go"
 )
 
 func usage() {
-	log.Printf("Usage: chat [-s server] [-creds file] [-n name]\n")
+	log.Printf("Usage: chat [-s server] [-creds file] [-n name] [-history n] [-history-window duration] [-max-posts n] [-unverified mark|drop] [-receipts=false] [-keywords words] [-mute channels] [-notify=false] [-archive dir]\n")
 	flag.PrintDefaults()
 }
 
@@ -36,24 +39,56 @@ func main() {
 	var server = flag.String("s", "localhost", "NATS System")
 	var name = flag.String("n", "", "Override Chat Name")
 	var userCreds = flag.String("creds", "", "User Credentials File")
+	var histLast = flag.Int("history", 100, "Posts to replay per channel, 0 disables history")
+	var histWindow = flag.Duration("history-window", 0, "Only replay posts this recent, e.g. 24h")
+	var maxPosts = flag.Int("max-posts", 500, "Posts kept in memory per channel and DM")
+	var unverified = flag.String("unverified", "mark", "Posts from users we can not verify, mark or drop")
+	var receipts = flag.Bool("receipts", true, "Let users know when we read their DMs")
+	var keywords = flag.String("keywords", "", "Words to highlight besides your name, comma separated")
+	var mute = flag.String("mute", "", "Channels to not notify for, comma separated")
+	var notify = flag.Bool("notify", true, "Show on the status line when mentioned")
+	var archiveDir = flag.String("archive", "", "Keep an encrypted archive of posts in this directory")
 
 	log.SetFlags(0)
 	flag.Usage = usage
 	flag.Parse()
 
 	// Use UserCredentials
-	if *userCreds == "" {
+	if *userCreds == "" || *maxPosts < 1 || (*unverified != "mark" && *unverified != "drop") {
 		showUsageAndExit(1)
 	}
 
 	// Initialize our state
-	s := newState(*userCreds)
+	s, err := newState(*userCreds, *maxPosts)
+	if errors.Is(err, creds.ErrExpired) {
+		log.Fatalf("I'm sorry, credentials have expired.")
+	}
+	if err != nil {
+		log.Fatalf("Could not load user credentials: %v", err)
+	}
+	s.histLast, s.histWindow = *histLast, *histWindow
+	s.dropUnverified = *unverified == "drop"
+	s.receipts = *receipts
+	s.notifications = *notify
+	s.setKeywords(*keywords)
+	for _, name := range strings.Split(*mute, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			s.muted[name] = true
+		}
+	}
+
+	if *archiveDir != "" {
+		if err := s.openArchive(*archiveDir); err != nil {
+			log.Fatalf("Could not open the archive: %v", err)
+		}
+	}
 
 	// Connect to NATS system
 	log.Print("Connecting to NATS system")
 	opts := []nats.Option{nats.Name("KUBECON NATS Chat")}
 	opts = setupConnOptions(opts)
-	opts = append(opts, nats.UserCredentials(*userCreds))
+	// Use our state for the JWT so we pick up renewed credentials.
+	opts = append(opts, nats.UserJWT(s.userJWT, s.signNonce))
 
 	// Connect to NATS
 	nc, err := nats.Connect(*server, opts...)
@@ -65,23 +100,35 @@ func main() {
 	// Setup NATS and announce ourselves.
 	s.setupNATS(nc, *userCreds, *name)
 
+	// Put back what we archived, before the UI shows it.
+	s.loadArchive()
+
 	// Setup terminal UI
 	ui := s.setupUI()
 
 	// Ctrl-C to exit.
 	ui.SetKeybinding("Ctrl+C", func() { ui.Quit() })
 
-	// Setup expiration timer if the user expires.
+	// Catch up on what was said before we got here.
+	go s.loadHistory()
+
+	// Setup expiration timer if the user expires, and renew
+	// our credentials ahead of that.
 	if s.me.Expires > 0 {
 		expiresInSecs := time.Duration(s.me.Expires - time.Now().Unix())
-		time.AfterFunc(time.Second*expiresInSecs, func() {
+		s.Lock()
+		s.expTimer = time.AfterFunc(time.Second*expiresInSecs, func() {
 			ui.Quit()
 			log.Fatalf("Your credentials have expired.")
 		})
+		s.scheduleRenewal(renewAfter(s.me))
+		s.Unlock()
 	}
 
 	// Loop on UI.
 	if err := ui.Run(); err != nil {
 		log.Fatal(err)
 	}
+	s.goOffline()
+	s.closeArchive()
 }
@@ -0,0 +1,212 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/marcusolsson/tui-go"
+)
+
+// Posts that mention us as @name, or one of the -keywords, are
+// highlighted. Those from channels are also collected under the
+// @mentions entry at the end of the channel list, which shows them
+// with the channel they were posted in. New ones are shown on the
+// status line under the messages for a while, unless started with
+// -notify=false or posted in a muted channel.
+//
+// Muted channels do not notify or count unread posts.
+
+const (
+	mentionsName = "@mentions"
+	mentionStyle = "mention"
+
+	// How long a mention stays on the status line.
+	notifyShown = 10 * time.Second
+)
+
+func init() {
+	tui.DefaultTheme.SetStyle("label."+mentionStyle, tui.Style{Bold: tui.DecorationOn, Fg: tui.ColorYellow})
+
+	registerCommand(&command{
+		name: "/mute",
+		args: "[channel]",
+		help: "Stop notifications and unread counts for a channel",
+		max:  1,
+		run: func(s *state, args []string) error {
+			return s.setMuted(args, true)
+		},
+		complete: (*state).channelNames,
+	})
+	registerCommand(&command{
+		name: "/unmute",
+		args: "[channel]",
+		help: "Notify and count unread posts for a channel again",
+		max:  1,
+		run: func(s *state, args []string) error {
+			return s.setMuted(args, false)
+		},
+		complete: (*state).channelNames,
+	})
+	registerCommand(&command{
+		name: "/keywords",
+		args: "[word...]",
+		help: "Show or set the words to highlight besides your name",
+		max:  16,
+		run: func(s *state, args []string) error {
+			if len(args) > 0 {
+				s.setKeywords(strings.Join(args, ","))
+			}
+			s.notice("Highlighting @" + s.name + " " + strings.Join(s.keywords, " "))
+			return nil
+		},
+		complete: noCompletion,
+	})
+}
+
+// setKeywords sets the words to highlight from a comma separated list.
+// Assume lock is held.
+func (s *state) setKeywords(list string) {
+	s.keywords = nil
+	for _, kw := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		s.keywords = append(s.keywords, strings.ToLower(kw))
+	}
+	sort.Strings(s.keywords)
+}
+
+// /mute and /unmute, of the current channel by default.
+// Lock should be held.
+func (s *state) setMuted(args []string, muted bool) error {
+	name := s.cur.name
+	if len(args) > 0 {
+		name = args[0]
+	} else if s.cur.kind != channel {
+		return fmt.Errorf("Pick a channel to mute, or name it")
+	}
+	if !s.hasChannel(name) {
+		return fmt.Errorf("No channel %q, try /join", name)
+	}
+	if muted {
+		s.muted[name] = true
+		delete(s.unread, name)
+		s.notice("Muted " + name)
+	} else {
+		delete(s.muted, name)
+		s.notice("Unmuted " + name)
+	}
+	s.queueUpdate(s.refreshChannels)
+	return nil
+}
+
+// isMention tells if a post from someone else mentions us or one of
+// our keywords. Assume lock is held.
+func (s *state) isMention(p *postClaim) bool {
+	if p.Issuer == s.me.Subject {
+		return false
+	}
+	msg, _ := p.Data["msg"].(string)
+	words := strings.FieldsFunc(strings.ToLower(msg), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '@' && r != '_' && r != '-'
+	})
+	for _, w := range words {
+		if w == "@"+s.name {
+			return true
+		}
+		for _, kw := range s.keywords {
+			if w == kw || w == "@"+kw {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// postStyle is the style of a post's message when not picked.
+// Assume lock is held.
+func (s *state) postStyle(p *postClaim) string {
+	if s.isMention(p) {
+		return mentionStyle
+	}
+	return ""
+}
+
+// mentioned collects a new channel post that mentions us, and notifies
+// unless the channel is muted or on display. Assume lock is held.
+func (s *state) mentioned(p *postClaim) {
+	if !s.isMention(p) {
+		return
+	}
+	s.mentions.add(p)
+	if s.cur != nil && s.cur.kind == mentions {
+		sel := s.cur
+		s.queueUpdate(func() {
+			s.Lock()
+			defer s.Unlock()
+			if s.cur == sel {
+				s.showPost(p)
+			}
+		})
+	} else {
+		s.unread[mentionsName]++
+		s.queueUpdate(s.refreshChannels)
+	}
+	if !s.muted[p.Subject] && !(s.cur != nil && s.cur.kind == channel && s.cur.name == p.Subject) {
+		s.notify(s.localUserName(p) + " in " + p.Subject)
+	}
+}
+
+// notify shows msg on the status line until notifyShown passed, or a
+// newer one replaced it. The terminal belongs to the UI, so this goes
+// through its goroutine. Assume lock is held.
+// with msg. Assume lock is held.
+func (s *state) notify(msg string) {
+	if !s.notifications {
+		return
+	}
+	msg = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, msg)
+	msg = time.Now().Format("15:04") + " " + msg
+	s.notifyMsg = msg
+	s.queueUpdate(s.showNotify)
+	time.AfterFunc(notifyShown, func() {
+		s.Lock()
+		defer s.Unlock()
+		if s.notifyMsg == msg {
+			s.notifyMsg = ""
+			s.queueUpdate(s.showNotify)
+		}
+	})
+}
+
+// Runs on the UI goroutine.
+func (s *state) showNotify() {
+	s.Lock()
+	defer s.Unlock()
+	if s.notifyLabel == nil {
+		return
+	}
+	if s.notifyMsg == "" {
+		s.notifyLabel.SetText("")
+		return
+	}
+	s.notifyLabel.SetText(" @ " + s.notifyMsg)
+}
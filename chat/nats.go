@@ -14,14 +14,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"regexp"
 	"sort"
 	"strings"
 	"time"
 
+	"github.com/connecteverything/oscon2019/creds"
 	jwt "github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
@@ -34,12 +34,27 @@ const (
 	postsSub  = preSub + "posts.*"
 	postsPub  = preSub + "posts.%s"
 	dmsPub    = preSub + "dms.%s"
+
+	// Typing in a channel, and in a DM to the user with the nkey.
+	typingSub   = preSub + "typing.*"
+	typingPub   = preSub + "typing.%s"
+	typingDMPub = preSub + "typing.dms.%s"
 )
 
 // This will setup our subscriptions for the chat service.
 func (s *state) setupNATS(nc *nats.Conn, creds, name string) {
 	s.nc = nc
 
+	// History is optional, we carry on without it.
+	if s.histLast > 0 {
+		js, err := nc.JetStream()
+		if err != nil {
+			log.Printf("Message history is not available: %v", err)
+		} else {
+			s.js = js
+		}
+	}
+
 	// Allow override
 	if name != "" {
 		s.name = displayName(name)
@@ -47,24 +62,50 @@ func (s *state) setupNATS(nc *nats.Conn, creds, name string) {
 		s.name = displayName(s.me.Name)
 	}
 
+	// Watch for revoked users, and load those we missed, before we take
+	// anything from them.
+	if _, err := nc.Subscribe(revokedSub, s.processRevoked); err != nil {
+		log.Fatalf("Could not subscribe to revocations: %v", err)
+	}
+	s.loadRevoked()
+
 	// Listen for new posts, direct msgs.
 	if _, err := nc.Subscribe(postsSub, s.processNewPost); err != nil {
 		log.Fatalf("Could not subscribe to new posts: %v", err)
 	}
 
+	// And reactions to posts.
+	if _, err := nc.Subscribe(reactionsSub, s.processReaction); err != nil {
+		log.Fatalf("Could not subscribe to reactions: %v", err)
+	}
+
 	// Only listen for DMs for us.
 	dmsSub := fmt.Sprintf(dmsPub, s.me.Subject)
 	if _, err := nc.Subscribe(dmsSub, s.processNewDM); err != nil {
 		log.Fatalf("Could not subscribe to new DMs: %v", err)
 	}
 
+	// And who is typing, in channels and to us.
+	if _, err := nc.Subscribe(typingSub, s.processTyping); err != nil {
+		log.Fatalf("Could not subscribe to typing: %v", err)
+	}
+	if _, err := nc.Subscribe(fmt.Sprintf(typingDMPub, s.me.Subject), s.processTyping); err != nil {
+		log.Fatalf("Could not subscribe to typing: %v", err)
+	}
+
 	// Watch for others coming online.
 	if _, err := nc.Subscribe(onlineSub, s.processUserUpdate); err != nil {
 		log.Fatalf("Could not subscribe to online status: %v", err)
 	}
 
+	// Learn about channels others have created.
+	if _, err := nc.Subscribe(channelsSub, s.processChannels); err != nil {
+		log.Fatalf("Could not subscribe to channels: %v", err)
+	}
+	s.queryChannels()
+
 	// Set our status to online.
-	s.sendFirstOnlineStatus()
+	s.startPresence()
 }
 
 const maxNameLen = 8
@@ -78,38 +119,6 @@ func displayName(name string) string {
 	return fname
 }
 
-const (
-	onlineInterval = 1 * time.Minute
-)
-
-func (s *state) sendFirstOnlineStatus() {
-	s.sendOnlineStatus(true)
-}
-func (s *state) sendOnlineStatusUpdate() {
-	s.sendOnlineStatus(false)
-}
-
-func (s *state) sendOnlineStatus(first bool) {
-	online := jwt.NewGenericClaims(s.me.Subject)
-	online.Name = s.name
-	online.Expires = time.Now().Add(onlineInterval).UTC().Unix() // 1 minute from now
-
-	// Type field is deprecated.
-	// online.Type = jwt.ClaimType("chat-online")
-	online.Data["type"] = "chat-online"
-
-	if first {
-		// Tags field is deprecated.
-		// online.Tags.Add("new")
-		online.Data["tags"] = []string{"chat-online"}
-	}
-	ojwt, _ := online.Encode(s.skp)
-	s.nc.Publish(onlineSub, []byte(ojwt))
-
-	// Send periodically while running.
-	time.AfterFunc(onlineInterval/2, s.sendOnlineStatusUpdate)
-}
-
 func (s *state) processUserUpdate(m *nats.Msg) {
 	userClaim, err := jwt.DecodeGeneric(string(m.Data))
 	if err != nil {
@@ -126,26 +135,64 @@ func (s *state) processUserUpdate(m *nats.Msg) {
 	s.Lock()
 	defer s.Unlock()
 
+	// Only the user can announce themselves.
+	if userClaim.Issuer != userClaim.Subject || s.isRevoked(userClaim.Subject) {
+		return
+	}
+	// Going offline only needs to be signed by them.
+	if parsePresence(userClaim.Data["status"]) == offline {
+		if u := s.users[userClaim.Subject]; u != nil && s.updatePresence(u, userClaim) {
+			s.queueUpdate(s.refreshDirect)
+		}
+		return
+	}
+	ujwt, _ := userClaim.Data["jwt"].(string)
+	uc, err := s.verifyUser(ujwt, userClaim.Subject)
+	if err != nil && ujwt != "" {
+		s.logErr("-ERR Could not verify %q: %v", userClaim.Name, err)
+	}
+	if err != nil && s.dropUnverified {
+		return
+	}
+	s.moderators[userClaim.Subject] = err == nil && uc.Tags.Contains(moderatorTag)
+	if was := s.verified[userClaim.Subject]; was != (err == nil) {
+		s.verified[userClaim.Subject] = err == nil
+		// Posts we already show from them need their marker updated.
+		if s.ui != nil && s.cur != nil {
+			s.refreshDisplay()
+		}
+	}
+
 	u := s.users[userClaim.Subject]
 	if u == nil {
 		u = s.addNewUser(userClaim.Name, userClaim.Subject)
-		s.ui.Update(func() {
-			u.disp = s.direct.Length()
-			s.direct.AddItems(dName(u))
-		})
+		s.updatePresence(u, userClaim)
+		s.queueUpdate(s.refreshDirect)
+	} else {
+		changed := s.updatePresence(u, userClaim)
+		if userClaim.Name != u.nick {
+			s.renameUser(u, userClaim.Name)
+			changed = true
+		}
+		if changed {
+			s.queueUpdate(s.refreshDirect)
+		}
+	}
+	if xkey, _ := userClaim.Data["xkey"].(string); nkeys.IsValidPublicCurveKey(xkey) {
+		u.xkey = xkey
 	}
-	u.last = time.Now()
 
 	// Tags field is deprecated.
 	// if userClaim.Tags.Contains("new") {
 	if tagsContains(userClaim.Data["tags"], "new") {
 		// Now send out status as well so they know us before next update.
-		s.sendOnlineStatus(false)
+		go s.sendOnlineStatus(false)
 	}
 }
 
+// Tags decode as []interface{}.
 func tagsContains(v interface{}, tag string) bool {
-	tags, ok := v.([]string)
+	tags, ok := v.([]interface{})
 	if !ok {
 		return false
 	}
@@ -158,26 +205,55 @@ func tagsContains(v interface{}, tag string) bool {
 	return false
 }
 
-func (s *state) postSubject() string {
-	var subj string
-	if s.cur.kind == direct {
-		if u := s.dms[s.cur.name]; u != nil {
-			subj = fmt.Sprintf(dmsPub, u.nkey)
-		}
-	} else {
-		subj = fmt.Sprintf(postsPub, s.cur.name)
+// post sends a channel post or DM and shows it. Lock should be held.
+func (s *state) post(newPost *postClaim) error {
+	if err := s.publish(newPost); err != nil {
+		return err
 	}
-	return subj
+	s.setReplyTo(nil)
+	s.typingSent = time.Time{}
+	s.addPostToCurrent(newPost)
+	s.indexCurrent(newPost)
+	s.showPost(newPost)
+	return nil
 }
 
-// Called when we send a channel post
-func (s *state) sendPost(m string) *postClaim {
-	newPost := s.newPost(m)
-	pjwt, _ := newPost.Encode(s.skp)
-	s.registerPost(newPost.ID)
+// publish signs and sends a claim to the current channel or DM. DMs
+// are sealed, which fails for users without a curve key.
+// Lock should be held.
+func (s *state) publish(newPost *postClaim) error {
+	if s.cur.kind == mentions {
+		return errors.New("Pick the channel to post in")
+	}
+	claim, subj, place := newPost.GenericClaims, fmt.Sprintf(postsPub, s.cur.name), s.cur.name
+	if s.cur.kind == direct {
+		u := s.dms[s.cur.name]
+		if u == nil {
+			return fmt.Errorf("No user %q", s.cur.name)
+		}
+		sealed, err := s.sealPost(newPost, u)
+		if err != nil {
+			return err
+		}
+		claim, subj, place = sealed, fmt.Sprintf(dmsPub, u.nkey), u.nkey
+	}
+	pjwt, err := claim.Encode(s.skp)
+	if err != nil {
+		return err
+	}
+	newPost.ID, newPost.raw = claim.ID, pjwt
+	if s.cur.kind == direct {
+		newPost.raw = s.ownDM(newPost)
+	}
+	s.registerPost(newPost)
 
-	s.nc.Publish(s.postSubject(), []byte(pjwt))
-	return newPost
+	if err := s.nc.Publish(subj, []byte(pjwt)); err != nil {
+		return err
+	}
+	if !isReceipt(newPost) {
+		s.archivePosts(s.cur.kind, place, []*postClaim{newPost})
+	}
+	return nil
 }
 
 func (s *state) checkPostClaim(claim string) *postClaim {
@@ -193,34 +269,61 @@ func (s *state) checkPostClaim(claim string) *postClaim {
 		return nil
 	}
 
-	return &postClaim{post}
+	return &postClaim{GenericClaims: post, raw: claim}
 }
 
 // Receive a new channel post from another user.
 func (s *state) processNewPost(m *nats.Msg) {
 	post := s.checkPostClaim(string(m.Data))
-	if post == nil || s.posts[post.Subject] == nil {
+	if post == nil {
 		return
 	}
 
 	s.Lock()
 	defer s.Unlock()
 
-	if s.postIsDupe(post.ID) {
+	if !s.hasChannel(post.Subject) || !s.acceptPost(post) || s.postIsDupe(post) {
 		return
 	}
-	s.posts[post.Subject] = append(s.posts[post.Subject], post)
-
-	if s.cur.kind == channel && s.cur.name == post.Subject {
-		s.ui.Update(func() {
-			s.msgs.AppendRow(s.postEntry(post))
+	r := s.posts[post.Subject]
+	// Dedupe forgets posts after a while, replays can be older than that.
+	if s.findPost(r, post.ID) != nil {
+		return
+	}
+	s.archivePosts(channel, post.Subject, []*postClaim{post})
+	if isChange(post) {
+		if s.recordChanges(r, []*postClaim{post}) && s.cur != nil && s.cur.kind == channel && s.cur.name == post.Subject {
+			s.refreshDisplay()
+		}
+		return
+	}
+	if len(s.applyChanges([]*postClaim{post})) == 0 {
+		return
+	}
+	evicted := r.add(post)
+	s.search.add(post, channel, post.Subject)
+	s.stoppedTyping(typingKey{channel, post.Subject}, post.Issuer)
+
+	// Posts can arrive before the UI has selected anything.
+	if sel := s.cur; sel != nil && sel.kind == channel && sel.name == post.Subject {
+		s.keepScrollback(sel, evicted)
+		s.queueUpdate(func() {
+			s.Lock()
+			defer s.Unlock()
+			if s.cur == sel {
+				s.showPost(post)
+			}
 		})
+	} else if !s.muted[post.Subject] {
+		s.unread[post.Subject]++
+		s.queueUpdate(s.refreshChannels)
 	}
+	s.mentioned(post)
 }
 
 // Receive a new channel post from another user.
 func (s *state) processNewDM(m *nats.Msg) {
-	post := s.checkPostClaim(string(m.Data))
+	post := s.checkDMClaim(string(m.Data))
 	if post == nil {
 		return
 	}
@@ -229,26 +332,58 @@ func (s *state) processNewDM(m *nats.Msg) {
 
 	// We don't allow DMs from new users. We should know the user already.
 	u := s.users[post.Issuer]
-	if u == nil {
+	if u == nil || !s.acceptPost(post) || s.postIsDupe(post) || s.findPost(u.posts, post.ID) != nil {
+		s.Unlock()
 		return
 	}
-	u.posts = append(u.posts, post)
+	if isReceipt(post) {
+		if s.recordReceipt(post) && s.cur != nil && s.cur.kind == direct && s.cur.name == u.name {
+			s.refreshDisplay()
+		}
+		s.Unlock()
+		return
+	}
+	s.archivePosts(direct, u.nkey, []*postClaim{post})
+	if isChange(post) {
+		if s.recordChanges(u.posts, []*postClaim{post}) && s.cur != nil && s.cur.kind == direct && s.cur.name == u.name {
+			s.refreshDisplay()
+		}
+		s.Unlock()
+		return
+	}
+	if len(s.applyChanges([]*postClaim{post})) == 0 {
+		s.Unlock()
+		return
+	}
+	evicted := u.posts.add(post)
+	s.search.add(post, direct, u.nkey)
+	s.stoppedTyping(typingKey{direct, u.nkey}, u.nkey)
 
 	// snapshot
-	ui := s.ui
-	msgs := s.msgs
-	selected := s.cur.kind == direct && s.cur.name == u.name
+	sel := s.cur
+	selected := sel != nil && sel.kind == direct && sel.name == u.name
+	if selected {
+		s.keepScrollback(sel, evicted)
+	} else {
+		u.unread++
+	}
+	if s.isMention(post) {
+		s.notify(u.name + " in a DM")
+	}
 	s.Unlock()
 
 	// Update display if we are currently being viewed.
 	if selected {
-		ui.Update(func() {
-			msgs.AppendRow(s.postEntry(post))
+		s.queueUpdate(func() {
+			s.Lock()
+			defer s.Unlock()
+			if s.cur == sel {
+				s.showPost(post)
+				s.ackDM()
+			}
 		})
 	} else {
-		ui.Update(func() {
-			s.updateNewMsgState(u.nkey, true)
-		})
+		s.queueUpdate(s.refreshDirect)
 	}
 }
 
@@ -265,43 +400,18 @@ func (s *state) userListSorted() []*user {
 
 // Lock should be held.
 func (s *state) logErr(format string, args ...interface{}) {
-	if s.input.IsFocused() {
+	if s.input == nil || s.input.IsFocused() {
 		log.Printf(format, args...)
 	}
 }
 
-var nscDecoratedRe = regexp.MustCompile(`\s*(?:(?:[-]{3,}[^\n]*[-]{3,}\n)(.+)(?:\n\s*[-]{3,}[^\n]*[-]{3,}\n))`)
-
-func loadUser(creds string) (*jwt.UserClaims, nkeys.KeyPair) {
-	contents, err := ioutil.ReadFile(creds)
-	if err != nil {
-		log.Fatalf("Could not load user credentials: %v", err)
-	}
-	items := nscDecoratedRe.FindAllSubmatch(contents, -1)
-	if len(items) != 2 {
-		log.Fatal("Expected user JWT and seed!")
-	}
-	ujwt := items[0][1]
-	seed := items[1][1]
-
-	kp, err := nkeys.FromSeed(seed)
+// loadUser needs both the JWT and seed, since we sign our posts.
+func loadUser(file string) (string, *jwt.UserClaims, nkeys.KeyPair, error) {
+	c, err := creds.LoadUser(file)
 	if err != nil {
-		log.Fatalf("Could not decode seed: %v", err)
-	}
-	for i := range seed {
-		seed[i] = 'x'
+		return "", nil, nil, err
 	}
-
-	uc, err := jwt.DecodeUserClaims(string(ujwt))
-	if err != nil {
-		log.Fatalf("Could not decode user: %v", err)
-	}
-	// Check if we have expired.
-	if uc.Expires > 0 && uc.Expires < time.Now().UTC().Unix() {
-		log.Fatalf("I'm sorry, credentials have expired.")
-	}
-
-	return uc, kp
+	return c.JWT, c.Claims, c.KeyPair, nil
 }
 
 func setupConnOptions(opts []nats.Option) []nats.Option {
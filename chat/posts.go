@@ -0,0 +1,168 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// postRing holds the last posts of a channel or DM, oldest first.
+// Dropped is set once posts have been evicted, those may still be
+// loaded from history with /older.
+type postRing struct {
+	buf     []*postClaim
+	start   int
+	n       int
+	dropped bool
+}
+
+func newPostRing(size int) *postRing {
+	return &postRing{buf: make([]*postClaim, size)}
+}
+
+func (r *postRing) len() int {
+	return r.n
+}
+
+// add appends p and returns the post it evicted, if any.
+func (r *postRing) add(p *postClaim) *postClaim {
+	if r.n < len(r.buf) {
+		r.buf[(r.start+r.n)%len(r.buf)] = p
+		r.n++
+		return nil
+	}
+	evicted := r.buf[r.start]
+	r.buf[r.start] = p
+	r.start = (r.start + 1) % len(r.buf)
+	r.dropped = true
+	return evicted
+}
+
+// first returns the oldest post we hold.
+func (r *postRing) first() *postClaim {
+	if r.n == 0 {
+		return nil
+	}
+	return r.buf[r.start]
+}
+
+// all returns a copy of the posts, oldest first.
+func (r *postRing) all() []*postClaim {
+	posts := make([]*postClaim, 0, r.n)
+	for i := 0; i < r.n; i++ {
+		posts = append(posts, r.buf[(r.start+i)%len(r.buf)])
+	}
+	return posts
+}
+
+// find returns the post with the given ID, nil if we do not hold it.
+func (r *postRing) find(id string) *postClaim {
+	for i := 0; i < r.n; i++ {
+		if p := r.buf[(r.start+i)%len(r.buf)]; p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// remove drops the post with the given ID, and returns if we held it.
+func (r *postRing) remove(id string) bool {
+	posts := r.all()
+	for i, p := range posts {
+		if p.ID != id {
+			continue
+		}
+		posts = append(posts[:i], posts[i+1:]...)
+		for j := range r.buf {
+			r.buf[j] = nil
+		}
+		r.start, r.n = 0, copy(r.buf, posts)
+		return true
+	}
+	return false
+}
+
+// merge adds posts from history, keeping the newest in the order
+// they were sent.
+func (r *postRing) merge(posts []*postClaim) {
+	merged := sortPosts(append(r.all(), posts...))
+	if over := len(merged) - len(r.buf); over > 0 {
+		merged = merged[over:]
+		r.dropped = true
+	}
+	for i := range r.buf {
+		r.buf[i] = nil
+	}
+	r.start, r.n = 0, copy(r.buf, merged)
+}
+
+// sortPosts drops repeated posts and orders them by when they were sent.
+func sortPosts(posts []*postClaim) []*postClaim {
+	seen := make(map[string]bool, len(posts))
+	uniq := posts[:0]
+	for _, p := range posts {
+		if !seen[p.ID] {
+			seen[p.ID] = true
+			uniq = append(uniq, p)
+		}
+	}
+	sort.SliceStable(uniq, func(i, j int) bool {
+		return uniq[i].IssuedAt < uniq[j].IssuedAt
+	})
+	return uniq
+}
+
+// Posts have no expiration, so we remember their IDs for this long,
+// which covers redelivery and the overlap of history with live posts.
+const dedupeWindow = 10 * time.Minute
+
+// dedupe remembers the IDs of posts we have seen until the later of
+// the dedupe window and their expiration. Expired IDs are swept at
+// most every half window.
+type dedupe struct {
+	seen  map[string]int64
+	swept time.Time
+}
+
+func newDedupe() *dedupe {
+	return &dedupe{seen: make(map[string]int64), swept: time.Now()}
+}
+
+func (d *dedupe) has(jti string) bool {
+	until, ok := d.seen[jti]
+	return ok && until >= time.Now().Unix()
+}
+
+func (d *dedupe) add(jti string, expires int64) {
+	now := time.Now()
+	until := now.Add(dedupeWindow).Unix()
+	if expires > until {
+		until = expires
+	}
+	d.seen[jti] = until
+	d.sweep(now)
+}
+
+func (d *dedupe) sweep(now time.Time) {
+	if now.Sub(d.swept) < dedupeWindow/2 {
+		return
+	}
+	for jti, until := range d.seen {
+		if until < now.Unix() {
+			delete(d.seen, jti)
+		}
+	}
+	d.swept = now
+}
@@ -0,0 +1,173 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	jwt "github.com/nats-io/jwt/v2"
+)
+
+// post returns a post with the given ID sent at the given time.
+func post(id string, issuedAt int64) *postClaim {
+	gc := jwt.NewGenericClaims("General")
+	gc.ID, gc.IssuedAt = id, issuedAt
+	return &postClaim{GenericClaims: gc}
+}
+
+func ids(posts []*postClaim) []string {
+	ids := []string{}
+	for _, p := range posts {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func TestPostRing(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		add     []string
+		remove  []string
+		want    []string
+		evicted []string
+		dropped bool
+	}{
+		{"empty", 3, nil, nil, []string{}, nil, false},
+		{"partial", 3, []string{"a", "b"}, nil, []string{"a", "b"}, nil, false},
+		{"full", 3, []string{"a", "b", "c"}, nil, []string{"a", "b", "c"}, nil, false},
+		{"wraps", 3, []string{"a", "b", "c", "d", "e"}, nil, []string{"c", "d", "e"}, []string{"a", "b"}, true},
+		{"remove", 3, []string{"a", "b", "c"}, []string{"b"}, []string{"a", "c"}, nil, false},
+		{"remove wrapped", 3, []string{"a", "b", "c", "d"}, []string{"c"}, []string{"b", "d"}, []string{"a"}, true},
+		{"remove missing", 3, []string{"a"}, []string{"b"}, []string{"a"}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newPostRing(tt.size)
+			var evicted []string
+			for i, id := range tt.add {
+				if e := r.add(post(id, int64(i))); e != nil {
+					evicted = append(evicted, e.ID)
+				}
+			}
+			for _, id := range tt.remove {
+				r.remove(id)
+			}
+			if got := ids(r.all()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("all() = %v, want %v", got, tt.want)
+			}
+			if r.len() != len(tt.want) {
+				t.Errorf("len() = %d, want %d", r.len(), len(tt.want))
+			}
+			if !reflect.DeepEqual(evicted, tt.evicted) {
+				t.Errorf("evicted %v, want %v", evicted, tt.evicted)
+			}
+			if r.dropped != tt.dropped {
+				t.Errorf("dropped = %v, want %v", r.dropped, tt.dropped)
+			}
+			for _, id := range tt.want {
+				if p := r.find(id); p == nil || p.ID != id {
+					t.Errorf("find(%q) = %v", id, p)
+				}
+			}
+			for _, id := range append(tt.evicted, tt.remove...) {
+				if p := r.find(id); p != nil {
+					t.Errorf("find(%q) found a post we do not hold", id)
+				}
+			}
+			if len(tt.want) > 0 && r.first().ID != tt.want[0] {
+				t.Errorf("first() = %q, want %q", r.first().ID, tt.want[0])
+			}
+		})
+	}
+}
+
+func TestPostRingMerge(t *testing.T) {
+	tests := []struct {
+		name    string
+		have    []*postClaim
+		merge   []*postClaim
+		want    []string
+		dropped bool
+	}{
+		{"into empty", nil, []*postClaim{post("b", 2), post("a", 1)}, []string{"a", "b"}, false},
+		{"older", []*postClaim{post("c", 3)}, []*postClaim{post("a", 1), post("b", 2)}, []string{"a", "b", "c"}, false},
+		{"repeated", []*postClaim{post("a", 1), post("b", 2)}, []*postClaim{post("b", 2)}, []string{"a", "b"}, false},
+		{"keeps newest", []*postClaim{post("d", 4)}, []*postClaim{post("a", 1), post("b", 2), post("c", 3)}, []string{"b", "c", "d"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newPostRing(3)
+			for _, p := range tt.have {
+				r.add(p)
+			}
+			r.merge(tt.merge)
+			if got := ids(r.all()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("all() = %v, want %v", got, tt.want)
+			}
+			if r.dropped != tt.dropped {
+				t.Errorf("dropped = %v, want %v", r.dropped, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		expires int64
+		seen    bool
+	}{
+		{"no expiration", 0, true},
+		{"expired", now.Add(-time.Hour).Unix(), true},
+		{"later expiration", now.Add(time.Hour).Unix(), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDedupe()
+			if d.has("jti") {
+				t.Fatal("new dedupe has seen jti")
+			}
+			d.add("jti", tt.expires)
+			if d.has("jti") != tt.seen {
+				t.Fatalf("has() = %v, want %v", !tt.seen, tt.seen)
+			}
+			if d.has("other") {
+				t.Fatal("has() an ID we never added")
+			}
+		})
+	}
+}
+
+func TestDedupeSweep(t *testing.T) {
+	d := newDedupe()
+	now := time.Now()
+	d.seen["old"] = now.Add(-time.Minute).Unix()
+	d.seen["new"] = now.Add(2 * dedupeWindow).Unix()
+
+	// Not swept again before half a window passed.
+	d.sweep(now)
+	if len(d.seen) != 2 {
+		t.Fatalf("swept too early: %v", d.seen)
+	}
+	d.sweep(now.Add(dedupeWindow))
+	if _, ok := d.seen["old"]; ok {
+		t.Error("expired ID was not swept")
+	}
+	if _, ok := d.seen["new"]; !ok {
+		t.Error("live ID was swept")
+	}
+}
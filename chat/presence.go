@@ -0,0 +1,224 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	jwt "github.com/nats-io/jwt/v2"
+)
+
+// Presence is announced with an online claim every half interval,
+// which expires after the interval. Users whose claim lapsed are
+// offline, and we say so ourselves when we exit. Users that have been
+// offline for a day and never sent us a DM are dropped from the list.
+type presence int
+
+const (
+	offline = presence(iota)
+	online
+	away
+	busy
+)
+
+const (
+	onlineInterval = 1 * time.Minute
+	// Our going offline claim only needs to outlive delivery.
+	offlineGrace   = 5 * time.Second
+	presenceForget = 24 * time.Hour
+)
+
+var presenceNames = map[presence]string{
+	offline: "offline",
+	online:  "online",
+	away:    "away",
+	busy:    "busy",
+}
+
+func (p presence) String() string {
+	return presenceNames[p]
+}
+
+// Older clients do not send a status, they are online.
+func parsePresence(status interface{}) presence {
+	for p, name := range presenceNames {
+		if name == status {
+			return p
+		}
+	}
+	return online
+}
+
+// startPresence announces us and keeps doing so while we run, and
+// expires those we stop hearing from.
+func (s *state) startPresence() {
+	s.Lock()
+	s.status = online
+	s.Unlock()
+	s.sendOnlineStatus(true)
+
+	go func() {
+		for range time.NewTicker(onlineInterval / 2).C {
+			s.sendOnlineStatus(false)
+			s.expirePresence()
+		}
+	}()
+}
+
+// Lock should not be held.
+func (s *state) sendOnlineStatus(first bool) {
+	s.Lock()
+	online := jwt.NewGenericClaims(s.me.Subject)
+	online.Name = s.name
+	online.Data["status"] = s.status.String()
+	// Others verify us with our user JWT, and seal DMs to our curve key.
+	online.Data["jwt"] = s.ujwt
+	online.Data["xkey"] = s.xpub
+	s.Unlock()
+	online.Expires = time.Now().Add(onlineInterval).UTC().Unix() // 1 minute from now
+
+	// Type field is deprecated.
+	// online.Type = jwt.ClaimType("chat-online")
+	online.Data["type"] = "chat-online"
+
+	if first {
+		// Tags field is deprecated.
+		// online.Tags.Add("new")
+		online.Data["tags"] = []string{"new"}
+	}
+	ojwt, _ := online.Encode(s.skp)
+	s.nc.Publish(onlineSub, []byte(ojwt))
+}
+
+// goOffline tells everyone we are leaving. Lock should not be held.
+func (s *state) goOffline() {
+	s.Lock()
+	offline := jwt.NewGenericClaims(s.me.Subject)
+	offline.Name = s.name
+	offline.Expires = time.Now().Add(offlineGrace).UTC().Unix()
+	offline.Data["type"] = "chat-online"
+	offline.Data["status"] = "offline"
+	s.Unlock()
+
+	ojwt, _ := offline.Encode(s.skp)
+	s.nc.Publish(onlineSub, []byte(ojwt))
+	s.nc.FlushTimeout(time.Second)
+}
+
+func init() {
+	for _, p := range []presence{away, busy, online} {
+		p := p
+		name, help := "/"+p.String(), "Let others know you are "+p.String()
+		if p == online {
+			name, help = "/back", "Let others know you are back"
+		}
+		registerCommand(&command{
+			name: name,
+			help: help,
+			run: func(s *state, _ []string) error {
+				s.setStatus(p)
+				return nil
+			},
+			complete: noCompletion,
+		})
+	}
+	registerCommand(&command{
+		name: "/who",
+		help: "List users and their presence",
+		run: func(s *state, _ []string) error {
+			s.showWho()
+			return nil
+		},
+		complete: noCompletion,
+	})
+}
+
+// /away, /busy and /back. Lock should be held.
+func (s *state) setStatus(p presence) {
+	s.status = p
+	if u := s.users[s.me.Subject]; u != nil {
+		u.state = p
+	}
+	go s.sendOnlineStatus(false)
+	s.queueUpdate(s.refreshDirect)
+	s.notice("You are " + p.String())
+}
+
+// updatePresence records what a user announced, and returns if the
+// DM list needs to be redrawn. Assume lock is held.
+func (s *state) updatePresence(u *user, claim *jwt.GenericClaims) bool {
+	was := u.state
+	u.state = parsePresence(claim.Data["status"])
+	u.last = time.Now()
+	u.expires = time.Unix(claim.Expires, 0)
+	return u.state != was
+}
+
+// expirePresence marks users whose online claim lapsed as offline,
+// and forgets those that have been gone for long.
+func (s *state) expirePresence() {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	changed := false
+	for nkey, u := range s.users {
+		if nkey == s.me.Subject {
+			continue
+		}
+		if u.state != offline && now.After(u.expires) {
+			u.state = offline
+			changed = true
+		}
+		if u.state == offline && now.Sub(u.last) > presenceForget && u.posts.len() == 0 &&
+			!(s.cur != nil && s.cur.kind == direct && s.cur.name == u.name) {
+			delete(s.users, nkey)
+			delete(s.dms, u.name)
+			changed = true
+		}
+	}
+	if changed && s.ui != nil {
+		s.queueUpdate(s.refreshDirect)
+	}
+}
+
+// Lock should be held.
+func (s *state) showWho() {
+	var who []string
+	for _, u := range s.userListSorted() {
+		who = append(who, u.name+presenceLabel(u))
+	}
+	s.notice("Users: " + strings.Join(who, ", "))
+}
+
+// presenceLabel is shown after a user's name on the DM list.
+func presenceLabel(u *user) string {
+	switch {
+	case u.state == away || u.state == busy:
+		return " (" + u.state.String() + ")"
+	case u.state == offline && u.last.IsZero():
+		return " (offline)"
+	case u.state == offline:
+		return " (seen " + lastSeen(u.last) + ")"
+	}
+	return ""
+}
+
+func lastSeen(t time.Time) string {
+	if time.Since(t) < 24*time.Hour {
+		return t.Format("15:04")
+	}
+	return t.Format("Jan 2")
+}
@@ -0,0 +1,210 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	jwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+)
+
+// Reactions to channel posts are claims carrying the JTI of the post
+// as ref and a short emoji or token, sent on the reactions subject of
+// the channel. Reacting again with the same one takes it back, which
+// is sent as a reaction with remove set. We count who reacted with
+// what per post, and show the counts after the post. Reactions older
+// than the last one a user sent for a post are dropped, so a replayed
+// one can not undo what came after it. Reactions are not kept in
+// history.
+
+const (
+	reactionsSub  = preSub + "reactions.*"
+	reactionsPub  = preSub + "reactions.%s"
+	reactionType  = "chat-reaction"
+	maxReactionSz = 16
+	// Posts we keep reactions for at most.
+	maxReacted = 10000
+)
+
+// reactionSet holds who reacted to a post, by reaction.
+type reactionSet map[string]map[string]bool
+
+func init() {
+	registerCommand(&command{
+		name: "/react",
+		args: "<emoji>",
+		help: "React to the picked post, or the last one, again to take it back",
+		min:  1, max: 1,
+		run: func(s *state, args []string) error {
+			return s.react(args[0])
+		},
+		complete: func(s *state) []string {
+			return s.usedReactions()
+		},
+	})
+}
+
+// Lock should be held.
+func (s *state) react(reaction string) error {
+	if s.cur.kind != channel {
+		return errors.New("Reactions are only for channel posts")
+	}
+	if len(reaction) > maxReactionSz || !utf8.ValidString(reaction) {
+		return fmt.Errorf("Reactions are at most %d bytes", maxReactionSz)
+	}
+	target := s.replyTo
+	if target == nil && len(s.shown) > 0 {
+		target = s.shown[len(s.shown)-1].post
+	}
+	if target == nil {
+		return errors.New("No post to react to, pick one with Ctrl+R")
+	}
+
+	rc := jwt.NewGenericClaims(s.cur.name)
+	rc.Name = s.name
+	rc.Data["type"] = reactionType
+	rc.Data["ref"] = target.ID
+	rc.Data["reaction"] = reaction
+	if s.reactions[target.ID][reaction][s.me.Subject] {
+		rc.Data["remove"] = true
+	}
+	rjwt, err := rc.Encode(s.skp)
+	if err != nil {
+		return err
+	}
+	if err := s.nc.Publish(fmt.Sprintf(reactionsPub, s.cur.name), []byte(rjwt)); err != nil {
+		return err
+	}
+	r := &postClaim{GenericClaims: rc}
+	s.registerPost(r)
+	s.addReaction(r)
+	s.setReplyTo(nil)
+	s.setPostsDisplay(s.cur)
+	return nil
+}
+
+// Receive a reaction to a channel post.
+func (s *state) processReaction(m *nats.Msg) {
+	rc := s.checkPostClaim(string(m.Data))
+	if rc == nil || rc.Data["type"] != reactionType {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// Permissions are checked against the subject, so the claim has to
+	// be for the channel it was sent to.
+	if m.Subject != fmt.Sprintf(reactionsPub, rc.Subject) {
+		return
+	}
+	if !s.hasChannel(rc.Subject) || !s.acceptPost(rc) || s.postIsDupe(rc) {
+		return
+	}
+	if !s.addReaction(rc) {
+		return
+	}
+	if s.cur != nil && s.cur.kind == channel && s.cur.name == rc.Subject && s.isShown(refOf(rc)) {
+		s.refreshDisplay()
+	}
+}
+
+// addReaction counts a reaction, or takes it back, and returns if the
+// counts changed. Assume lock is held.
+func (s *state) addReaction(rc *postClaim) bool {
+	ref := refOf(rc)
+	reaction, _ := rc.Data["reaction"].(string)
+	if ref == "" || reaction == "" || len(reaction) > maxReactionSz {
+		return false
+	}
+	remove, _ := rc.Data["remove"].(bool)
+	if rc.IssuedAt < s.reactedAt[ref][rc.Issuer] {
+		return false
+	}
+
+	rs := s.reactions[ref]
+	if rs == nil {
+		if remove {
+			return false
+		}
+		if len(s.reactions) >= maxReacted {
+			for old := range s.reactions {
+				delete(s.reactions, old)
+				delete(s.reactedAt, old)
+				break
+			}
+		}
+		rs = make(reactionSet)
+		s.reactions[ref] = rs
+		s.reactedAt[ref] = make(map[string]int64)
+	}
+	s.reactedAt[ref][rc.Issuer] = rc.IssuedAt
+	who := rs[reaction]
+	if who[rc.Issuer] != remove {
+		return false
+	}
+	if remove {
+		delete(who, rc.Issuer)
+		if len(who) == 0 {
+			delete(rs, reaction)
+		}
+		return true
+	}
+	if who == nil {
+		who = make(map[string]bool)
+		rs[reaction] = who
+	}
+	who[rc.Issuer] = true
+	return true
+}
+
+// reactionCounts is shown after a post, e.g. " [👍 2] [🎉 1]".
+// Assume lock is held.
+func (s *state) reactionCounts(p *postClaim) string {
+	rs := s.reactions[p.ID]
+	if len(rs) == 0 {
+		return ""
+	}
+	reactions := make([]string, 0, len(rs))
+	for r := range rs {
+		reactions = append(reactions, r)
+	}
+	sort.Strings(reactions)
+	var b strings.Builder
+	for _, r := range reactions {
+		fmt.Fprintf(&b, " [%s %d]", r, len(rs[r]))
+	}
+	return b.String()
+}
+
+// usedReactions completes /react with what others reacted with.
+// Lock should be held.
+func (s *state) usedReactions() []string {
+	seen := make(map[string]bool)
+	var used []string
+	for _, rs := range s.reactions {
+		for r := range rs {
+			if !seen[r] {
+				seen[r] = true
+				used = append(used, r)
+			}
+		}
+	}
+	return used
+}
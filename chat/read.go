@@ -0,0 +1,166 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/marcusolsson/tui-go"
+	jwt "github.com/nats-io/jwt/v2"
+)
+
+// Posts that arrive for channels and DMs we are not looking at are
+// counted as unread on the sidebar. When we switch to them a marker
+// line shows where the unread posts start.
+//
+// When we read DMs we send the sender a receipt, a claim on their DM
+// subject carrying the JTI of the last post we read as ref, unless
+// started with -receipts=false. Our DMs they have read are shown with
+// a check mark.
+
+const (
+	receiptType = "chat-read"
+	readMark    = " ✓"
+)
+
+func unreadLabel(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s %d", highlighted, n)
+}
+
+func isReceipt(p *postClaim) bool {
+	return p.Data["type"] == receiptType
+}
+
+// markUnread notes where the unread posts of a selection we switch to
+// start, and clears its count. Assume lock is held.
+func (s *state) markUnread(sel *selection, r *postRing) {
+	n := 0
+	switch sel.kind {
+	case channel, mentions:
+		n = s.unread[sel.name]
+		if n > 0 {
+			delete(s.unread, sel.name)
+			s.queueUpdate(s.refreshChannels)
+		}
+	case direct:
+		if u := s.dms[sel.name]; u != nil && u.unread > 0 {
+			n, u.unread = u.unread, 0
+			s.queueUpdate(s.refreshDirect)
+		}
+	}
+	if posts := r.all(); n > 0 && n <= len(posts) {
+		sel.newFrom = posts[len(posts)-n].ID
+	}
+}
+
+// readMarker goes before the first unread post. Assume lock is held.
+func (s *state) readMarker() {
+	s.rows++
+	s.msgs.AppendRow(tui.NewHBox(
+		tui.NewSpacer(),
+		tui.NewLabel("──── new ────"),
+		tui.NewSpacer(),
+	))
+}
+
+// refreshChannels redraws the channel list with unread counts. Runs
+// on the UI goroutine, with the lock not held.
+func (s *state) refreshChannels() {
+	s.Lock()
+	defer s.Unlock()
+	s.drawChannels()
+}
+
+// drawChannels lists the channels, and @mentions after them, keeping
+// the one we show selected. Assume lock is held.
+func (s *state) drawChannels() {
+	selected := -1
+	s.channels.OnSelectionChanged(nil)
+	s.channels.RemoveItems()
+	for i, name := range s.chOrder {
+		if s.cur != nil && s.cur.kind == channel && s.cur.name == name {
+			selected = i
+		}
+		s.channels.AddItems(s.chLabel(name))
+	}
+	if s.cur != nil && s.cur.kind == mentions {
+		selected = len(s.chOrder)
+	}
+	s.channels.AddItems(s.chLabel(mentionsName))
+	s.channels.SetSelected(selected)
+	if selected >= 0 {
+		s.cur.index = selected
+	}
+	s.channels.OnSelectionChanged(s.chSelChanged)
+}
+
+// ackDM sends a receipt for the last DM from the user on display, if
+// we have not already. Assume lock is held.
+func (s *state) ackDM() {
+	if !s.receipts || s.cur == nil || s.cur.kind != direct {
+		return
+	}
+	u := s.dms[s.cur.name]
+	if u == nil || u.nkey == s.me.Subject {
+		return
+	}
+	var last *postClaim
+	for _, p := range u.posts.all() {
+		if p.Issuer == u.nkey {
+			last = p
+		}
+	}
+	if last == nil || last.ID == u.acked {
+		return
+	}
+	rc := &postClaim{GenericClaims: jwt.NewGenericClaims(s.cur.name)}
+	rc.Name = s.name
+	rc.Data["type"] = receiptType
+	rc.Data["ref"] = last.ID
+	if err := s.publish(rc); err != nil {
+		s.logErr("-ERR Could not send read receipt: %v", err)
+		return
+	}
+	u.acked = last.ID
+}
+
+// recordReceipt notes up to when the sender read our DMs, and returns
+// if that changed. Assume lock is held.
+func (s *state) recordReceipt(rc *postClaim) bool {
+	u := s.users[rc.Issuer]
+	if u == nil {
+		return false
+	}
+	readAt := rc.IssuedAt
+	if p := u.posts.find(refOf(rc)); p != nil {
+		readAt = p.IssuedAt
+	}
+	if readAt <= u.readAt {
+		return false
+	}
+	u.readAt = readAt
+	return true
+}
+
+// isRead tells if a DM we sent has been read. Assume lock is held.
+func (s *state) isRead(p *postClaim) bool {
+	if p.Issuer != s.me.Subject || s.cur == nil || s.cur.kind != direct {
+		return false
+	}
+	u := s.dms[s.cur.name]
+	return u != nil && p.IssuedAt <= u.readAt
+}
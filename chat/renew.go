@@ -0,0 +1,170 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/connecteverything/oscon2019/creds"
+	jwt "github.com/nats-io/jwt/v2"
+)
+
+const (
+	renewSubj    = "chat.req.renew"
+	renewVersion = 1
+	renewTimeout = 5 * time.Second
+
+	// We retry this often if chat-access is not around.
+	renewRetry = 30 * time.Second
+)
+
+// Should match chat-access versions. Our JWT is not sent, it is bigger
+// than what most roles may publish, chat-access looks us up instead.
+type renewRequest struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	NKey    string `json:"nkey"`
+	Nonce   string `json:"nonce"`
+	Sig     string `json:"sig"`
+}
+
+type renewResponse struct {
+	Status      int    `json:"status"`
+	Error       string `json:"error,omitempty"`
+	Description string `json:"description,omitempty"`
+	JWT         string `json:"jwt,omitempty"`
+	Expires     int64  `json:"exp,omitempty"`
+}
+
+// Callbacks for nats.UserJWT so reconnects always use our latest JWT.
+func (s *state) userJWT() (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.ujwt, nil
+}
+
+func (s *state) signNonce(nonce []byte) ([]byte, error) {
+	return s.skp.Sign(nonce)
+}
+
+// renewAfter returns when we should ask for new credentials, which is
+// when a fifth of their lifetime is left.
+func renewAfter(uc *jwt.UserClaims) time.Duration {
+	exp := time.Unix(uc.Expires, 0)
+	margin := exp.Sub(time.Unix(uc.IssuedAt, 0)) / 5
+	if margin < time.Minute {
+		margin = time.Minute
+	}
+	return time.Until(exp.Add(-margin))
+}
+
+// Lock should be held.
+func (s *state) scheduleRenewal(d time.Duration) {
+	if s.me.Expires == 0 {
+		return
+	}
+	if s.renewTimer != nil {
+		s.renewTimer.Stop()
+	}
+	s.renewTimer = time.AfterFunc(d, s.renewCreds)
+}
+
+// renewCreds will request a new JWT for our nkey from chat-access. The
+// current connection is left alone, the server will drop it once the old
+// JWT expires and we reconnect with the new one, keeping all UI state.
+func (s *state) renewCreds() {
+	uc, ujwt, err := s.requestRenewal()
+
+	s.Lock()
+	defer s.Unlock()
+	if err != nil {
+		s.logErr("-ERR Could not renew credentials: %v", err)
+		s.scheduleRenewal(renewRetry)
+		return
+	}
+	s.me, s.ujwt = uc, ujwt
+	s.trustOwnIssuer()
+	if err := s.saveCreds(); err != nil {
+		s.logErr("-ERR Could not save renewed credentials: %v", err)
+	}
+	if s.expTimer != nil {
+		s.expTimer.Reset(time.Until(time.Unix(uc.Expires, 0)))
+	}
+	s.scheduleRenewal(renewAfter(uc))
+}
+
+func (s *state) requestRenewal() (*jwt.UserClaims, string, error) {
+	s.Lock()
+	nc, name, nkey := s.nc, s.me.Name, s.me.Subject
+	s.Unlock()
+
+	var rnd [16]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return nil, "", err
+	}
+	nonce := fmt.Sprintf("%d.%s", time.Now().Unix(), hex.EncodeToString(rnd[:]))
+	sig, err := s.skp.Sign([]byte(nonce))
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := json.Marshal(&renewRequest{
+		Version: renewVersion,
+		Name:    name,
+		NKey:    nkey,
+		Nonce:   nonce,
+		Sig:     base64.RawURLEncoding.EncodeToString(sig),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	m, err := nc.Request(renewSubj, req, renewTimeout)
+	if err != nil {
+		return nil, "", err
+	}
+	var resp renewResponse
+	if err := json.Unmarshal(m.Data, &resp); err != nil {
+		return nil, "", err
+	}
+	if resp.Error != "" {
+		return nil, "", fmt.Errorf("%s: %s", resp.Error, resp.Description)
+	}
+	uc, err := jwt.DecodeUserClaims(resp.JWT)
+	if err != nil {
+		return nil, "", err
+	}
+	if uc.Subject != nkey {
+		return nil, "", fmt.Errorf("renewed JWT is for another user")
+	}
+	return uc, resp.JWT, nil
+}
+
+// saveCreds writes our current credentials back to the creds file so
+// the next run can use them. Lock should be held.
+func (s *state) saveCreds() error {
+	seed, err := s.skp.Seed()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for i := range seed {
+			seed[i] = 'x'
+		}
+	}()
+	return creds.Write(s.creds, s.ujwt, seed, "Renewed by chat")
+}
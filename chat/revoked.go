@@ -0,0 +1,104 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	jwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+)
+
+// chat-access announces revoked users here and answers requests for
+// the full deny-list. Both are signed by our account.
+const (
+	revokedSub  = preSub + "revoked"
+	revokedSubj = "chat.req.revoked"
+)
+
+// checkAccountClaim makes sure a claim was signed by the same account
+// key that signed our own user JWT.
+func (s *state) checkAccountClaim(claim string) (*jwt.GenericClaims, error) {
+	gc, err := jwt.DecodeGeneric(claim)
+	if err != nil {
+		return nil, err
+	}
+	vr := jwt.CreateValidationResults()
+	gc.Validate(vr)
+	if vr.IsBlocking(true) {
+		return nil, fmt.Errorf("blocking issues: %+v", vr)
+	}
+	if gc.Issuer != s.me.Issuer && gc.Issuer != s.me.IssuerAccount {
+		return nil, fmt.Errorf("not signed by our account")
+	}
+	return gc, nil
+}
+
+// loadRevoked asks for the current deny-list, which also has the
+// signing keys of our account. chat-access may not be running, in
+// which case we rely on the announcements alone.
+func (s *state) loadRevoked() {
+	m, err := s.nc.Request(revokedSubj, nil, 2*time.Second)
+	if err != nil {
+		return
+	}
+	gc, err := s.checkAccountClaim(string(m.Data))
+	if err != nil {
+		log.Printf("-ERR Received a bad deny-list: %v", err)
+		return
+	}
+	keys, _ := gc.Data["revoked"].([]interface{})
+	signingKeys, _ := gc.Data["signing_keys"].([]interface{})
+
+	s.Lock()
+	defer s.Unlock()
+	s.trustSigningKeys(signingKeys)
+	for _, k := range keys {
+		if nkey, ok := k.(string); ok {
+			s.revoked[nkey] = struct{}{}
+		}
+	}
+	if s.isRevoked(s.me.Subject) {
+		log.Fatalf("Your credentials have been revoked.")
+	}
+}
+
+func (s *state) processRevoked(m *nats.Msg) {
+	gc, err := s.checkAccountClaim(string(m.Data))
+	if err != nil {
+		s.logErr("-ERR Received a bad revocation: %v", err)
+		return
+	}
+
+	s.Lock()
+	s.revoked[gc.Subject] = struct{}{}
+	me := gc.Subject == s.me.Subject
+	ui := s.ui
+	s.Unlock()
+
+	if me {
+		if ui != nil {
+			ui.Quit()
+		}
+		log.Fatalf("Your credentials have been revoked.")
+	}
+}
+
+// Assume lock is held.
+func (s *state) isRevoked(nkey string) bool {
+	_, ok := s.revoked[nkey]
+	return ok
+}
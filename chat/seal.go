@@ -0,0 +1,126 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/connecteverything/oscon2019/creds"
+	jwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+// DMs are sealed with curve (x25519) keys so only the recipient can
+// read them. Everyone publishes their public curve key with their
+// online status, and we only send DMs to users that have one. The DM
+// is still a claim signed by the sender, carrying the sender's curve
+// key and the sealed message instead of the message itself.
+//
+// The curve key is kept next to the creds, so DMs from history can
+// still be opened after a restart.
+
+// Sealed posts are shown with this in front.
+const sealedMark = "🔒 "
+
+// loadCurveKey reads our curve key, or creates one on first use.
+func loadCurveKey(credsFile string) (nkeys.KeyPair, error) {
+	file := credsFile + ".xk"
+	xkp, err := creds.LoadSeed(file, nkeys.PrefixByteCurve)
+	if !errors.Is(err, os.ErrNotExist) {
+		return xkp, err
+	}
+	if xkp, err = nkeys.CreateCurveKeys(); err != nil {
+		return nil, err
+	}
+	seed, err := xkp.Seed()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range seed {
+			seed[i] = 'x'
+		}
+	}()
+	if err := ioutil.WriteFile(file, append(seed, '\n'), 0600); err != nil {
+		return nil, err
+	}
+	return xkp, nil
+}
+
+// sealPost returns the claim to send for a DM to u. It gets the same
+// ID as p when encoded, so we can dedupe our own post.
+// Assume lock is held.
+func (s *state) sealPost(p *postClaim, u *user) (*jwt.GenericClaims, error) {
+	if u.xkey == "" {
+		return nil, fmt.Errorf("%s has not published an encryption key, DMs to them are disabled", u.name)
+	}
+	msg, _ := p.Data["msg"].(string)
+	sealed, err := s.xkp.Seal([]byte(msg), u.xkey)
+	if err != nil {
+		return nil, err
+	}
+	claim := *p.GenericClaims
+	claim.Data = map[string]interface{}{
+		"type":   p.Data["type"],
+		"xkey":   s.xpub,
+		"sealed": base64.StdEncoding.EncodeToString(sealed),
+	}
+	for _, k := range []string{"action", "reply_to", "ref"} {
+		if v, ok := p.Data[k]; ok {
+			claim.Data[k] = v
+		}
+	}
+	p.sealed = true
+	return &claim, nil
+}
+
+// openPost opens a sealed DM in place. DMs that were not sealed are
+// left alone. Assume lock is held.
+func (s *state) openPost(p *postClaim) error {
+	data, ok := p.Data["sealed"].(string)
+	if !ok {
+		return nil
+	}
+	xkey, _ := p.Data["xkey"].(string)
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return err
+	}
+	msg, err := s.xkp.Open(sealed, xkey)
+	if err != nil {
+		return err
+	}
+	p.Data["msg"] = string(msg)
+	p.sealed = true
+	return nil
+}
+
+// checkDMClaim is checkPostClaim for DMs, which opens them as well.
+func (s *state) checkDMClaim(claim string) *postClaim {
+	p := s.checkPostClaim(claim)
+	if p == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	if err := s.openPost(p); err != nil {
+		s.logErr("-ERR Could not open DM from %q: %v", p.Name, err)
+		return nil
+	}
+	return p
+}
@@ -0,0 +1,393 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/marcusolsson/tui-go"
+)
+
+// Every post we receive, send or replay from history is indexed by
+// the words of its message, so /search can find it after it has left
+// the posts we keep. The index holds the last maxIndexed posts.
+//
+// A query matches posts with words starting with each of its words,
+// and can be narrowed with from:<user>, in:<channel or user>,
+// after:<date> and before:<date>, where a date is 2006-01-02 or how
+// long ago, e.g. 2h. Results are listed newest first in a pane over
+// the input, Enter jumps to the post and Esc closes the pane.
+
+const (
+	maxIndexed = 20000
+	maxResults = 50
+)
+
+// Where a post was posted, the channel name or the other user's nkey.
+type indexEntry struct {
+	post  *postClaim
+	kind  pkind
+	name  string
+	words []string
+}
+
+type searchIndex struct {
+	entries map[string]*indexEntry
+	words   map[string]map[string]bool
+	// IDs in the order they were indexed, to drop the oldest.
+	order []string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		entries: make(map[string]*indexEntry),
+		words:   make(map[string]map[string]bool),
+	}
+}
+
+func searchWords(msg string) []string {
+	return strings.FieldsFunc(strings.ToLower(msg), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// add indexes a post, again after it was edited.
+func (si *searchIndex) add(p *postClaim, kind pkind, name string) {
+	if e := si.entries[p.ID]; e != nil {
+		si.unlink(e)
+	} else {
+		si.order = append(si.order, p.ID)
+	}
+	msg, _ := p.Data["msg"].(string)
+	e := &indexEntry{post: p, kind: kind, name: name, words: searchWords(msg)}
+	si.entries[p.ID] = e
+	for _, w := range e.words {
+		if si.words[w] == nil {
+			si.words[w] = make(map[string]bool)
+		}
+		si.words[w][p.ID] = true
+	}
+	for len(si.order) > maxIndexed {
+		si.remove(si.order[0])
+	}
+}
+
+func (si *searchIndex) remove(id string) {
+	if e := si.entries[id]; e != nil {
+		si.unlink(e)
+		delete(si.entries, id)
+	}
+	for i, oid := range si.order {
+		if oid == id {
+			si.order = append(si.order[:i], si.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (si *searchIndex) unlink(e *indexEntry) {
+	for _, w := range e.words {
+		delete(si.words[w], e.post.ID)
+		if len(si.words[w]) == 0 {
+			delete(si.words, w)
+		}
+	}
+}
+
+// lookup returns the IDs of posts with a word starting with prefix.
+func (si *searchIndex) lookup(prefix string) map[string]bool {
+	ids := make(map[string]bool)
+	for w, posts := range si.words {
+		if strings.HasPrefix(w, prefix) {
+			for id := range posts {
+				ids[id] = true
+			}
+		}
+	}
+	return ids
+}
+
+// Assume lock is held.
+func (s *state) indexPosts(kind pkind, name string, posts []*postClaim) {
+	for _, p := range posts {
+		s.search.add(p, kind, name)
+	}
+}
+
+// indexCurrent indexes a post we sent. Assume lock is held.
+func (s *state) indexCurrent(p *postClaim) {
+	name := s.cur.name
+	if s.cur.kind == direct {
+		if u := s.dms[s.cur.name]; u != nil {
+			name = u.nkey
+		}
+	}
+	s.search.add(p, s.cur.kind, name)
+}
+
+// query is a parsed search.
+type query struct {
+	words         []string
+	from, in      string
+	after, before time.Time
+}
+
+func parseDate(v string) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.ParseInLocation("2006-01-02", v, time.Local)
+}
+
+func parseQuery(line string) (*query, error) {
+	q := &query{}
+	for _, f := range strings.Fields(line) {
+		i := strings.IndexByte(f, ':')
+		if i < 0 {
+			q.words = append(q.words, searchWords(f)...)
+			continue
+		}
+		var err error
+		switch k, v := f[:i], f[i+1:]; k {
+		case "from":
+			q.from = strings.TrimPrefix(v, "@")
+		case "in":
+			q.in = strings.TrimPrefix(v, "#")
+		case "after":
+			q.after, err = parseDate(v)
+		case "before":
+			q.before, err = parseDate(v)
+		default:
+			q.words = append(q.words, searchWords(f)...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bad date %q, use 2006-01-02 or e.g. 2h", f[i+1:])
+		}
+	}
+	if len(q.words) == 0 && q.from == "" && q.in == "" && q.after.IsZero() && q.before.IsZero() {
+		return nil, errors.New("Usage: /search <words> [from:user] [in:channel] [after:date] [before:date]")
+	}
+	return q, nil
+}
+
+// Assume lock is held.
+func (s *state) matches(q *query, e *indexEntry) bool {
+	p := e.post
+	if q.from != "" && s.localUserName(p) != q.from && p.Name != q.from {
+		return false
+	}
+	if q.in != "" && s.entryPlace(e) != q.in {
+		return false
+	}
+	t := time.Unix(p.IssuedAt, 0)
+	if !q.after.IsZero() && t.Before(q.after) {
+		return false
+	}
+	if !q.before.IsZero() && !t.Before(q.before) {
+		return false
+	}
+	return true
+}
+
+// entryPlace is the channel, or the user a DM is with.
+// Assume lock is held.
+func (s *state) entryPlace(e *indexEntry) string {
+	if e.kind == direct {
+		if u := s.users[e.name]; u != nil {
+			return u.name
+		}
+	}
+	return e.name
+}
+
+// Assume lock is held.
+func (s *state) runQuery(q *query) []*indexEntry {
+	var ids map[string]bool
+	for _, w := range q.words {
+		found := s.search.lookup(w)
+		if ids != nil {
+			for id := range ids {
+				if !found[id] {
+					delete(ids, id)
+				}
+			}
+		} else {
+			ids = found
+		}
+	}
+	var results []*indexEntry
+	if ids == nil {
+		for _, e := range s.search.entries {
+			if s.matches(q, e) {
+				results = append(results, e)
+			}
+		}
+	} else {
+		for id := range ids {
+			if e := s.search.entries[id]; e != nil && s.matches(q, e) {
+				results = append(results, e)
+			}
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].post.IssuedAt > results[j].post.IssuedAt
+	})
+	if len(results) > maxResults {
+		results = results[:maxResults]
+	}
+	return results
+}
+
+func init() {
+	registerCommand(&command{
+		name: "/search",
+		args: "<words> [from:user] [in:channel] [after:date] [before:date]",
+		help: "Search the posts we have seen",
+		min:  1, max: 1, rest: true,
+		run: func(s *state, args []string) error {
+			q, err := parseQuery(args[0])
+			if err != nil {
+				return err
+			}
+			s.showResults(args[0], s.runQuery(q))
+			return nil
+		},
+		complete: noCompletion,
+	})
+}
+
+// showResults lists the results in the search pane, and focuses it.
+// Lock should be held.
+func (s *state) showResults(line string, results []*indexEntry) {
+	if len(results) == 0 {
+		s.notice("Nothing found for " + line)
+		return
+	}
+	s.found = results
+	s.results.RemoveItems()
+	for _, e := range results {
+		t := time.Unix(e.post.IssuedAt, 0)
+		where := "#" + s.entryPlace(e)
+		if e.kind == direct {
+			where = "@" + s.entryPlace(e)
+		}
+		msg, _ := e.post.Data["msg"].(string)
+		if r := []rune(msg); len(r) > 60 {
+			msg = string(r[:60]) + "..."
+		}
+		s.results.AddItems(fmt.Sprintf("%s %s <%s> %s", t.Format("Jan 2 15:04"), where, s.localUserName(e.post), msg))
+	}
+	s.results.SetSelected(0)
+	s.resultsBox.SetTitle(fmt.Sprintf("Search: %s (%d)", line, len(results)))
+	if s.chatBox.Length() == 2 {
+		s.chatBox.Insert(1, s.resultsBox)
+	}
+	s.input.SetFocused(false)
+	s.results.SetFocused(true)
+}
+
+// closeSearch removes the search pane. Lock should be held.
+func (s *state) closeSearch() {
+	if s.chatBox.Length() == 3 {
+		s.chatBox.Remove(1)
+	}
+	s.found = nil
+	s.results.SetFocused(false)
+	s.input.SetFocused(true)
+}
+
+// jumpTo shows the post of the result picked in the search pane.
+// Selecting it on the lists calls back in, so the lock is not held.
+func (s *state) jumpTo(l *tui.List) {
+	s.Lock()
+	if l.Selected() < 0 || l.Selected() >= len(s.found) {
+		s.Unlock()
+		return
+	}
+	e := s.found[l.Selected()]
+	s.closeSearch()
+	index, list := -1, s.channels
+	switch e.kind {
+	case channel:
+		for i, name := range s.chOrder {
+			if name == e.name {
+				index = i
+			}
+		}
+	case direct:
+		list = s.direct
+		for i, u := range s.userListSorted() {
+			if u.nkey == e.name {
+				index = i
+			}
+		}
+	}
+	here := s.cur.kind == e.kind && s.selPosts(s.cur) == s.placePosts(e)
+	s.Unlock()
+
+	if index < 0 {
+		return
+	}
+	if !here {
+		list.Select(index)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	p := e.post
+	if s.findPost(s.selPosts(s.cur), p.ID) == nil {
+		// No longer kept, show it with the scrollback.
+		s.cur.older = sortPosts(append(s.cur.older, p))
+	}
+	s.setReplyTo(p)
+	s.setPostsDisplay(s.cur)
+	for i, sp := range s.shown {
+		if sp.post == p {
+			s.scrollTo(len(s.shown) - 1 - i)
+		}
+	}
+}
+
+// placePosts returns the posts of the place of an entry.
+// Assume lock is held.
+func (s *state) placePosts(e *indexEntry) *postRing {
+	if e.kind == direct {
+		if u := s.users[e.name]; u != nil {
+			return u.posts
+		}
+		return nil
+	}
+	return s.posts[e.name]
+}
+
+// scrollTo stops following new posts and scrolls up about as many
+// rows as follow the post we jumped to. Assume lock is held.
+func (s *state) scrollTo(rowsAfter int) {
+	s.msgsScroll.SetAutoscrollToBottom(false)
+	s.msgsScroll.ScrollToBottom()
+	s.msgsScroll.Scroll(0, -rowsAfter)
+}
+
+// follow goes back to showing the newest posts. Assume lock is held.
+func (s *state) follow() {
+	if s.msgsScroll != nil {
+		s.msgsScroll.SetAutoscrollToBottom(true)
+		s.msgsScroll.ScrollToBottom()
+	}
+}
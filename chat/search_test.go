@@ -0,0 +1,70 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.ParseInLocation("2006-01-02", s, time.Local)
+		return d
+	}
+	tests := []struct {
+		line string
+		want *query
+		ok   bool
+	}{
+		{"hello", &query{words: []string{"hello"}}, true},
+		{"Hello, World!", &query{words: []string{"hello", "world"}}, true},
+		{"from:@alice", &query{from: "alice"}, true},
+		{"from:alice in:#General nats", &query{words: []string{"nats"}, from: "alice", in: "General"}, true},
+		{"after:2020-10-01 before:2020-10-31", &query{after: day("2020-10-01"), before: day("2020-10-31")}, true},
+		{"at:noon", &query{words: []string{"at", "noon"}}, true},
+		{"", nil, false},
+		{"   ", nil, false},
+		{"!!!", nil, false},
+		{"after:yesterday", nil, false},
+		{"before:2020-13-01", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			q, err := parseQuery(tt.line)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", q)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(q, tt.want) {
+				t.Errorf("got %+v, want %+v", q, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQueryAgo(t *testing.T) {
+	q, err := parseQuery("after:2h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(q.after); d < 2*time.Hour || d > 2*time.Hour+time.Minute {
+		t.Errorf("after:2h is %v ago", d)
+	}
+}
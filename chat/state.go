@@ -30,29 +30,128 @@ type state struct {
 	sync.Mutex
 	nc    *nats.Conn
 	me    *jwt.UserClaims
+	ujwt  string
+	creds string
 	skp   nkeys.KeyPair
+	// Curve key for sealing DMs.
+	xkp   nkeys.KeyPair
+	xpub  string
 	name  string
-	posts map[string][]*postClaim
+	posts map[string]*postRing
 	dms   map[string]*user
 	users map[string]*user
-	dd    map[string]struct{}
+	dd    *dedupe
 	cur   *selection
 	ui    tui.UI
 
+	// Posts kept per channel and DM, rows and posts on display, and
+	// the post we picked to reply to.
+	maxPosts int
+	rows     int
+	shown    []shownPost
+	replyTo  *postClaim
+
+	// Our presence, and the position of the last user on the DM list.
+	status   presence
+	lastDisp int
+
+	// Who is typing where, until when, and where and when we last
+	// said we are typing.
+	typing     map[typingKey]map[string]time.Time
+	typingTo   typingKey
+	typingSent time.Time
+
+	// Updates to run on the UI goroutine.
+	updates *updateQueue
+
+	// Channels in the order they appear in the sidebar, and
+	// when we last saw a full directory of them.
+	chOrder       []string
+	lastDirectory time.Time
+
+	// Message history, js is nil when disabled. Loaded are the
+	// channels we have replayed.
+	js         nats.JetStreamContext
+	histLast   int
+	histWindow time.Duration
+	loaded     map[string]bool
+
+	// Users chat-access told us have been revoked.
+	revoked map[string]struct{}
+
+	// Our account, the keys it issues users with, and the users
+	// whose JWT we have checked.
+	account        string
+	issuers        map[string]bool
+	verified       map[string]bool
+	dropUnverified bool
+
+	// Verified users with the moderator role, and edits and deletes
+	// by the JTI of the post they change.
+	moderators map[string]bool
+	changes    map[string][]*postClaim
+
+	// Unread posts per channel, and if we send DM read receipts.
+	unread   map[string]int
+	receipts bool
+
+	// Posts that mention us or our keywords, channels we do not want
+	// to hear from, and if we notify at all.
+	mentions      *postRing
+	keywords      []string
+	muted         map[string]bool
+	notifications bool
+	// The latest mention, on the status line for a while.
+	notifyMsg string
+
+	// Posts we can search, and the results on the search pane.
+	search *searchIndex
+	found  []*indexEntry
+
+	// Our archive, nil unless asked for.
+	archive *archive
+
+	// Reactions by the JTI of the post they are for, and when each
+	// user last reacted to it.
+	reactions map[string]reactionSet
+	reactedAt map[string]map[string]int64
+
+	// Credential renewal and expiration.
+	renewTimer *time.Timer
+	expTimer   *time.Timer
+
 	// UI Items
-	msgs     *tui.Grid
-	channels *tui.List
-	direct   *tui.List
-	input    *tui.Entry
+	chatBox     *tui.Box
+	msgsScroll  *tui.ScrollArea
+	resultsBox  *tui.Box
+	results     *tui.List
+	msgs        *tui.Grid
+	typingLabel *tui.Label
+	notifyLabel *tui.Label
+	channels    *tui.List
+	direct      *tui.List
+	input       *tui.Entry
+	inputBox    *tui.Box
 }
 
+// Name is how we show a user, nick is the name they announced.
 type user struct {
 	name  string
+	nick  string
 	nkey  string
-	posts []*postClaim
+	posts *postRing
 	last  time.Time
 	disp  int
-	nmsgs bool
+	// Posts from them we have not seen, the last one we sent a
+	// receipt for, and up to when they read ours.
+	unread int
+	acked  string
+	readAt int64
+	// Public curve key to seal DMs to them with.
+	xkey string
+	// Presence, and when their online claim expires.
+	state   presence
+	expires time.Time
 }
 
 type pkind int
@@ -60,41 +159,82 @@ type pkind int
 const (
 	channel = pkind(iota)
 	direct
+	mentions
 )
 
+// Older are posts loaded from history with /older, they are
+// dropped when we switch away. NewFrom is the first unread post.
 type selection struct {
-	index int
-	name  string
-	kind  pkind
+	index   int
+	name    string
+	kind    pkind
+	older   []*postClaim
+	newFrom string
 }
 
+// Sealed is set for DMs that were sent end-to-end encrypted. Edited
+// is when the edit we show was sent, deleted posts are dropped. Raw
+// is the JWT we archive.
 type postClaim struct {
 	*jwt.GenericClaims
+	sealed  bool
+	edited  int64
+	deleted bool
+	raw     string
 }
 
-// Fixed channels for now. Not hard to allow creating new ones.
+// Everyone starts with the default channels, others are
+// learned from the channel directory.
 func (s *state) pre() {
-	s.posts["KUBECON"] = []*postClaim{}
-	s.posts["NATS"] = []*postClaim{}
-	s.posts["General"] = []*postClaim{}
+	for _, name := range defaultChannels {
+		s.addChannel(name)
+	}
 }
 
-func newState(creds string) *state {
+func newState(creds string, maxPosts int) (*state, error) {
 	s := &state{
-		posts: make(map[string][]*postClaim),
-		dms:   make(map[string]*user),
-		users: make(map[string]*user),
-		dd:    make(map[string]struct{}),
+		posts:    make(map[string]*postRing),
+		dms:      make(map[string]*user),
+		users:    make(map[string]*user),
+		dd:       newDedupe(),
+		revoked:  make(map[string]struct{}),
+		issuers:  make(map[string]bool),
+		verified: make(map[string]bool),
+		// Edits and deletes.
+		moderators: make(map[string]bool),
+		changes:    make(map[string][]*postClaim),
+		reactions:  make(map[string]reactionSet),
+		reactedAt:  make(map[string]map[string]int64),
+		unread:     make(map[string]int),
+		muted:      make(map[string]bool),
+		mentions:   newPostRing(maxPosts),
+		search:     newSearchIndex(),
+		typing:     make(map[typingKey]map[string]time.Time),
+		loaded:     make(map[string]bool),
+		creds:      creds,
+		maxPosts:   maxPosts,
+		updates:    newUpdateQueue(),
 	}
 	s.pre()
-	s.me, s.skp = loadUser(creds)
-	return s
+	var err error
+	if s.ujwt, s.me, s.skp, err = loadUser(creds); err != nil {
+		return nil, err
+	}
+	s.trustOwnIssuer()
+	if s.xkp, err = loadCurveKey(creds); err != nil {
+		return nil, fmt.Errorf("could not load DM encryption key: %v", err)
+	}
+	s.xpub, _ = s.xkp.PublicKey()
+	return s, nil
 }
 
 func (s *state) newPost(msg string) *postClaim {
-	newPost := &postClaim{jwt.NewGenericClaims(s.cur.name)}
+	newPost := &postClaim{GenericClaims: jwt.NewGenericClaims(s.cur.name)}
 	newPost.Name = s.name
 	newPost.Data["msg"] = msg
+	if s.replyTo != nil {
+		newPost.Data["reply_to"] = s.replyTo.ID
+	}
 	if s.cur.kind == direct {
 		// Type field is deprecated.
 		// newPost.Type = jwt.ClaimType("chat-dm")
@@ -114,35 +254,40 @@ func (s *state) selectFirstChannel() {
 
 const lpre = " - "
 
-func chName(name string) string {
-	return lpre + name
+// Assume lock is held.
+func (s *state) chLabel(name string) string {
+	label := lpre + name
+	if s.muted[name] {
+		label += " (muted)"
+	}
+	return label + unreadLabel(s.unread[name])
 }
 
 func dName(u *user) string {
-	name := lpre + u.name
-	if u.nmsgs {
-		name = name + highlighted
-	}
-	return name
+	return lpre + u.name + presenceLabel(u) + unreadLabel(u.unread)
 }
 
 const highlighted = " ●"
 
 func sName(name string) string {
 	name = name[len(lpre):]
-	// Remove highlighting.
-	if strings.HasSuffix(name, highlighted) {
-		name = name[:len(name)-len(highlighted)]
+	// Remove presence and highlighting, names have no spaces.
+	if i := strings.IndexByte(name, ' '); i >= 0 {
+		name = name[:i]
 	}
 	return name
 }
 
 func (s *state) chSel() *selection {
-	return &selection{
+	sel := &selection{
 		index: s.channels.Selected(),
 		name:  sName(s.channels.SelectedItem()),
 		kind:  channel,
 	}
+	if sel.name == mentionsName {
+		sel.kind = mentions
+	}
+	return sel
 }
 func (s *state) dmSel() *selection {
 	return &selection{
@@ -152,38 +297,116 @@ func (s *state) dmSel() *selection {
 	}
 }
 
+// Assume lock is held.
 func (s *state) addPostToCurrent(p *postClaim) {
-	switch s.cur.kind {
+	if r := s.selPosts(s.cur); r != nil {
+		s.keepScrollback(s.cur, r.add(p))
+	}
+}
+
+// selPosts returns the posts for a selection, nil if we have none.
+// Assume lock is held.
+func (s *state) selPosts(sel *selection) *postRing {
+	switch sel.kind {
 	case channel:
-		s.posts[s.cur.name] = append(s.posts[s.cur.name], p)
+		return s.posts[sel.name]
 	case direct:
-		u := s.dms[s.cur.name]
-		u.posts = append(u.posts, p)
+		if u := s.dms[sel.name]; u != nil {
+			return u.posts
+		}
+	case mentions:
+		return s.mentions
+	}
+	return nil
+}
+
+// keepScrollback moves a post evicted while on display to the end of
+// the scrollback, if there is one, so they stay in order. Scrollback
+// is bounded like the posts. Assume lock is held.
+func (s *state) keepScrollback(sel *selection, evicted *postClaim) {
+	if evicted == nil || sel != s.cur || len(sel.older) == 0 {
+		return
+	}
+	sel.older = append(sel.older, evicted)
+	if over := len(sel.older) - s.maxPosts; over > 0 {
+		sel.older = sel.older[over:]
 	}
 }
 
 // Assume lock is held
 func (s *state) setPostsDisplay(sel *selection) {
+	switching := sel != s.cur
+	if switching && s.replyTo != nil {
+		s.setReplyTo(nil)
+	}
+	if switching {
+		s.follow()
+	}
 	s.cur = sel
 	s.msgs.RemoveRows()
-	var posts []*postClaim
+	s.rows = 0
+	s.shown = nil
 	switch sel.kind {
 	case channel:
-		posts = s.posts[sel.name]
 		s.direct.SetSelected(-1)
-	case direct:
-		if u := s.dms[sel.name]; u != nil {
-			posts = u.posts
+		// Channels found after startup are replayed when first shown.
+		if s.ui != nil && s.js != nil && !s.loaded[sel.name] {
+			go s.loadChannelHistory(sel.name)
 		}
+	case direct:
 		s.channels.SetSelected(-1)
+	case mentions:
+		s.direct.SetSelected(-1)
+	}
+	s.drawTyping()
+	r := s.selPosts(sel)
+	if r == nil {
+		return
+	}
+	if switching {
+		s.markUnread(sel, r)
+	}
+	if r.dropped && len(sel.older) == 0 && s.js != nil {
+		s.notice("Older posts are in history, use /older to see them")
+	}
+	posts := append(append([]*postClaim(nil), sel.older...), r.all()...)
+	for _, tp := range threadOrder(posts) {
+		if tp.post.ID == sel.newFrom {
+			s.readMarker()
+		}
+		s.appendPost(tp.post, tp.depth)
 	}
-	for _, p := range posts {
-		s.msgs.AppendRow(s.postEntry(p))
+	s.ackDM()
+}
+
+// showPost shows a new post, which has already been added to the
+// posts of the current selection. Assume lock is held.
+func (s *state) showPost(p *postClaim) {
+	if s.inThread(p) {
+		s.setPostsDisplay(s.cur)
+		return
+	}
+	s.appendPost(p, 0)
+}
+
+// appendPost appends a post to those on display. New posts keep being
+// appended while we stay on a channel, so once there are about twice
+// as many rows as we keep posts we redraw. Assume lock is held.
+func (s *state) appendPost(p *postClaim, depth int) {
+	entry, label := s.postEntry(p, depth)
+	if p == s.replyTo {
+		label.SetStyleName(pickedStyle)
+	}
+	s.msgs.AppendRow(entry)
+	s.rows++
+	s.shown = append(s.shown, shownPost{p, label})
+	if s.rows > len(s.cur.older)+2*s.maxPosts {
+		s.setPostsDisplay(s.cur)
 	}
 }
 
 func (s *state) sameChannel() bool {
-	if s.cur == nil || s.cur.kind != channel || s.cur.index != s.channels.Selected() {
+	if s.cur == nil || s.cur.kind == direct || s.cur.index != s.channels.Selected() {
 		return false
 	}
 	return true
@@ -197,39 +420,55 @@ func (s *state) sameDirect() bool {
 }
 
 func (s *state) addNewUser(name, nkey string) *user {
-	u := &user{name, nkey, nil, time.Now(), 0, false}
+	s.lastDisp++
+	u := &user{nick: name, nkey: nkey, posts: newPostRing(s.maxPosts), disp: s.lastDisp}
 	s.users[nkey] = u
+	u.name = s.uniqueName(name)
+	s.dms[u.name] = u
+	return u
+}
 
-	du := s.dms[u.name]
-	if du == nil {
-		s.dms[u.name] = u
-	} else {
-		// We have a collision here. e.g. chose the same simple name.
-		// Attempt to find a new one in form name(2), name(3).
-		for i := 2; i < 10002; i++ {
-			u.name = fmt.Sprintf("%s(%d)", name, i)
-			du := s.dms[u.name]
-			if du == nil {
-				s.dms[u.name] = u
-				return u
-			}
+// renameUser follows a user changing their name with /nick.
+// Assume lock is held.
+func (s *state) renameUser(u *user, nick string) {
+	if s.dms[u.name] == u {
+		delete(s.dms, u.name)
+	}
+	name := s.uniqueName(nick)
+	if s.cur != nil && s.cur.kind == direct && s.cur.name == u.name {
+		s.cur.name = name
+	}
+	u.name, u.nick = name, nick
+	s.dms[name] = u
+}
+
+// uniqueName returns the name we show a user as. Assume lock is held.
+func (s *state) uniqueName(name string) string {
+	if s.dms[name] == nil {
+		return name
+	}
+	// We have a collision here. e.g. chose the same simple name.
+	// Attempt to find a new one in form name(2), name(3).
+	for i := 2; i < 10002; i++ {
+		alt := fmt.Sprintf("%s(%d)", name, i)
+		if s.dms[alt] == nil {
+			return alt
 		}
-		log.Fatalf("Name collision error, alternatives exhausted")
 	}
-	return u
+	log.Fatalf("Name collision error, alternatives exhausted")
+	return ""
 }
 
 // Assume lock is held.
-// FIXME(dlc) - make this and posts bound.
-func (s *state) postIsDupe(jti string) bool {
-	if _, ok := s.dd[jti]; ok {
+func (s *state) postIsDupe(p *postClaim) bool {
+	if s.dd.has(p.ID) {
 		return true
 	}
-	s.registerPost(jti)
+	s.registerPost(p)
 	return false
 }
 
 // Assume lock is held.
-func (s *state) registerPost(jti string) {
-	s.dd[jti] = struct{}{}
+func (s *state) registerPost(p *postClaim) {
+	s.dd.add(p.ID, p.Expires)
 }
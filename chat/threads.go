@@ -0,0 +1,178 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/marcusolsson/tui-go"
+)
+
+// Replies carry the JTI of the post they reply to as reply_to. Posts
+// are shown with their replies right after them, indented. A reply to
+// a post we do not have is shown on its own until the post arrives,
+// from history or late, and we redraw.
+//
+// Ctrl+R picks the last post to reply to, again or Up moves to older
+// posts, Down to newer ones and Esc stops. What is sent next is a
+// reply to the picked post.
+
+const (
+	maxThreadDepth = 4
+	// Style for the picked post.
+	pickedStyle = "picked"
+)
+
+func init() {
+	tui.DefaultTheme.SetStyle("label."+pickedStyle, tui.Style{Reverse: tui.DecorationOn})
+}
+
+// A post on display, with the label we highlight when it is picked.
+type shownPost struct {
+	post  *postClaim
+	label *tui.Label
+}
+
+type threadedPost struct {
+	post  *postClaim
+	depth int
+}
+
+func replyOf(p *postClaim) string {
+	parent, _ := p.Data["reply_to"].(string)
+	return parent
+}
+
+// threadOrder puts replies right after the post they reply to, and
+// otherwise keeps posts in the order they were sent.
+func threadOrder(posts []*postClaim) []threadedPost {
+	have := make(map[string]bool, len(posts))
+	for _, p := range posts {
+		have[p.ID] = true
+	}
+	replies := make(map[string][]*postClaim)
+	var roots []*postClaim
+	for _, p := range posts {
+		if parent := replyOf(p); parent != "" && parent != p.ID && have[parent] {
+			replies[parent] = append(replies[parent], p)
+		} else {
+			roots = append(roots, p)
+		}
+	}
+
+	ordered := make([]threadedPost, 0, len(posts))
+	seen := make(map[string]bool, len(posts))
+	var walk func(p *postClaim, depth int)
+	walk = func(p *postClaim, depth int) {
+		if seen[p.ID] {
+			return
+		}
+		seen[p.ID] = true
+		ordered = append(ordered, threadedPost{p, depth})
+		if depth < maxThreadDepth {
+			depth++
+		}
+		for _, r := range replies[p.ID] {
+			walk(r, depth)
+		}
+	}
+	for _, p := range roots {
+		walk(p, 0)
+	}
+	// Forged replies could form a loop without a root.
+	for _, p := range posts {
+		walk(p, 0)
+	}
+	return ordered
+}
+
+// Assume lock is held.
+func (s *state) isShown(id string) bool {
+	for _, sp := range s.shown {
+		if sp.post.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// inThread tells if a new post belongs to a thread on display, which
+// means we have to redraw to show it in place. Assume lock is held.
+func (s *state) inThread(p *postClaim) bool {
+	if parent := replyOf(p); parent != "" && s.isShown(parent) {
+		return true
+	}
+	for _, sp := range s.shown {
+		if replyOf(sp.post) == p.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// threadPrefix goes in front of the user of a reply.
+func threadPrefix(p *postClaim, depth int) string {
+	switch {
+	case depth > 0:
+		return strings.Repeat("  ", depth-1) + "↳ "
+	case replyOf(p) != "":
+		return "↳ (unseen post) "
+	}
+	return ""
+}
+
+// pickPost moves the pick by delta posts, starting after the last post.
+// Moving past the last post stops picking. Assume lock is held.
+func (s *state) pickPost(delta int) {
+	i := len(s.shown)
+	for j, sp := range s.shown {
+		if sp.post == s.replyTo {
+			i = j
+			sp.label.SetStyleName(s.postStyle(sp.post))
+		}
+	}
+	i += delta
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(s.shown) {
+		s.setReplyTo(nil)
+		return
+	}
+	s.shown[i].label.SetStyleName(pickedStyle)
+	s.setReplyTo(s.shown[i].post)
+}
+
+// setReplyTo shows what we reply to on the input box.
+// Assume lock is held.
+func (s *state) setReplyTo(p *postClaim) {
+	if p == nil && s.replyTo != nil {
+		for _, sp := range s.shown {
+			if sp.post == s.replyTo {
+				sp.label.SetStyleName(s.postStyle(sp.post))
+			}
+		}
+	}
+	s.replyTo = p
+	if p == nil {
+		s.inputBox.SetTitle("")
+		s.follow()
+		return
+	}
+	msg, _ := p.Data["msg"].(string)
+	if r := []rune(msg); len(r) > 20 {
+		msg = string(r[:20]) + "..."
+	}
+	s.inputBox.SetTitle("Reply to " + s.localUserName(p) + ": " + msg)
+}
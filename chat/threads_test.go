@@ -0,0 +1,54 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// reply returns a post sent at the given time in reply to parent.
+func reply(id string, issuedAt int64, parent string) *postClaim {
+	p := post(id, issuedAt)
+	p.Data["reply_to"] = parent
+	return p
+}
+
+func TestThreadOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		posts []*postClaim
+		want  []string
+	}{
+		{"no replies", []*postClaim{post("a", 1), post("b", 2)}, []string{"a:0", "b:0"}},
+		{"reply after parent", []*postClaim{post("a", 1), post("b", 2), reply("c", 3, "a")}, []string{"a:0", "c:1", "b:0"}},
+		{"nested", []*postClaim{post("a", 1), reply("b", 2, "a"), reply("c", 3, "b"), reply("d", 4, "a")}, []string{"a:0", "b:1", "c:2", "d:1"}},
+		{"unknown parent", []*postClaim{post("a", 1), reply("b", 2, "x")}, []string{"a:0", "b:0"}},
+		{"reply to itself", []*postClaim{reply("a", 1, "a")}, []string{"a:0"}},
+		{"loop", []*postClaim{reply("a", 1, "b"), reply("b", 2, "a")}, []string{"a:0", "b:1"}},
+		{"depth capped", []*postClaim{post("a", 1), reply("b", 2, "a"), reply("c", 3, "b"), reply("d", 4, "c"), reply("e", 5, "d"), reply("f", 6, "e")},
+			[]string{"a:0", "b:1", "c:2", "d:3", "e:4", "f:4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, tp := range threadOrder(tt.posts) {
+				got = append(got, fmt.Sprintf("%s:%d", tp.post.ID, tp.depth))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
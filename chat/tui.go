@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/marcusolsson/tui-go"
@@ -24,7 +25,9 @@ import (
 
 func (s *state) setupUI() tui.UI {
 	s.channels = tui.NewList()
-	s.channels.AddItems(chName("KUBECON"), chName("NATS"), chName("General"))
+	s.Lock()
+	s.drawChannels()
+	s.Unlock()
 
 	s.direct = tui.NewList()
 
@@ -40,33 +43,53 @@ func (s *state) setupUI() tui.UI {
 
 	s.msgs = tui.NewGrid(4, 0)
 
-	msgsScroll := tui.NewScrollArea(s.msgs)
-	msgsScroll.SetAutoscrollToBottom(true)
-	msgsBox := tui.NewVBox(msgsScroll)
+	s.msgsScroll = tui.NewScrollArea(s.msgs)
+	s.msgsScroll.SetAutoscrollToBottom(true)
+	s.typingLabel = tui.NewLabel("")
+	s.notifyLabel = tui.NewLabel("")
+	s.notifyLabel.SetStyleName(mentionStyle)
+	msgsBox := tui.NewVBox(s.msgsScroll, s.typingLabel, s.notifyLabel)
 	msgsBox.SetBorder(true)
 
 	s.input = tui.NewEntry()
 	s.input.SetSizePolicy(tui.Expanding, tui.Maximum)
 
-	inputBox := tui.NewHBox(s.input)
-	inputBox.SetBorder(true)
-	inputBox.SetSizePolicy(tui.Expanding, tui.Maximum)
+	s.inputBox = tui.NewHBox(s.input)
+	s.inputBox.SetBorder(true)
+	s.inputBox.SetSizePolicy(tui.Expanding, tui.Maximum)
+
+	// The search pane goes between the two when open.
+	s.results = tui.NewList()
+	s.results.OnItemActivated(s.jumpTo)
+	s.resultsBox = tui.NewVBox(s.results)
+	s.resultsBox.SetBorder(true)
 
-	chat := tui.NewVBox(msgsBox, inputBox)
-	chat.SetSizePolicy(tui.Expanding, tui.Expanding)
+	s.chatBox = tui.NewVBox(msgsBox, s.inputBox)
+	s.chatBox.SetSizePolicy(tui.Expanding, tui.Expanding)
 
 	s.input.OnSubmit(func(e *tui.Entry) {
-		if m := e.Text(); m != "" {
+		if m := e.Text(); strings.HasPrefix(m, "/") {
 			s.Lock()
-			p := s.sendPost(m)
-			s.addPostToCurrent(p)
-			s.msgs.AppendRow(s.postEntry(p))
+			s.runCommand(m)
+			s.Unlock()
+			e.SetText("")
+		} else if m != "" {
+			s.Lock()
+			if err := s.post(s.newPost(m)); err != nil {
+				s.notice(err.Error())
+			}
 			s.Unlock()
 			e.SetText("")
 		}
 	})
 
-	root := tui.NewHBox(sidebar, chat)
+	s.input.OnChanged(func(e *tui.Entry) {
+		s.Lock()
+		s.inputChanged(e.Text())
+		s.Unlock()
+	})
+
+	root := tui.NewHBox(sidebar, s.chatBox)
 
 	ui, err := tui.New(root)
 	if err != nil {
@@ -79,21 +102,7 @@ func (s *state) setupUI() tui.UI {
 		s.channels.SetFocused(false)
 		s.input.SetFocused(true)
 	})
-	s.channels.OnSelectionChanged(func(l *tui.List) {
-		s.Lock()
-		defer s.Unlock()
-		if s.sameChannel() {
-			if s.cur.index > 0 {
-				s.channels.SetFocused(false)
-				s.direct.SetFocused(true)
-			}
-			return
-		}
-		if s.channels.Selected() >= 0 {
-			s.setPostsDisplay(s.chSel())
-			s.direct.SetSelected(-1)
-		}
-	})
+	s.channels.OnSelectionChanged(s.chSelChanged)
 
 	s.direct.OnItemActivated(func(l *tui.List) {
 		s.direct.SetFocused(false)
@@ -103,13 +112,50 @@ func (s *state) setupUI() tui.UI {
 
 	s.selectFirstChannel()
 
+	// Picking a post to reply to.
+	ui.SetKeybinding("Ctrl+R", func() {
+		s.Lock()
+		defer s.Unlock()
+		if s.input.IsFocused() {
+			s.pickPost(-1)
+		}
+	})
+	ui.SetKeybinding("Up", func() {
+		s.Lock()
+		defer s.Unlock()
+		if s.input.IsFocused() && s.replyTo != nil {
+			s.pickPost(-1)
+		}
+	})
+	ui.SetKeybinding("Down", func() {
+		s.Lock()
+		defer s.Unlock()
+		if s.input.IsFocused() && s.replyTo != nil {
+			s.pickPost(1)
+		}
+	})
+	ui.SetKeybinding("Esc", func() {
+		s.Lock()
+		defer s.Unlock()
+		if s.found != nil {
+			s.closeSearch()
+			return
+		}
+		s.setReplyTo(nil)
+	})
+
 	// Navigation
 	ui.SetKeybinding("TAB", func() {
 		s.Lock()
 		defer s.Unlock()
+		// Complete commands instead while typing one.
+		if m := s.input.Text(); s.input.IsFocused() && strings.HasPrefix(m, "/") {
+			s.input.SetText(s.completeCommand(m))
+			return
+		}
 		if s.input.IsFocused() {
 			s.input.SetFocused(false)
-			if s.cur == nil || s.cur.kind == channel {
+			if s.cur == nil || s.cur.kind != direct {
 				s.direct.SetFocused(false)
 				s.channels.SetFocused(true)
 			} else {
@@ -119,47 +165,123 @@ func (s *state) setupUI() tui.UI {
 		} else {
 			s.channels.SetFocused(false)
 			s.direct.SetFocused(false)
+			s.results.SetFocused(false)
 			s.input.SetFocused(true)
 		}
 	})
 
-	// Show ourselves on the DM list.
+	// Show ourselves first on the DM list.
+	s.Lock()
 	u := s.addNewUser(s.name, s.me.Subject)
-	s.direct.AddItems(dName(u))
+	u.xkey, u.state, u.disp = s.xpub, s.status, 0
+	s.Unlock()
+	s.refreshDirect()
 
+	// Catch up with channels that arrived while we were setting up,
+	// from now on they are added through queued updates.
+	s.Lock()
+	s.drawChannels()
 	s.ui = ui
+	s.Unlock()
+	go s.runUpdates(ui)
 	return ui
 }
 
+// UI updates are queued and run in order on the UI goroutine. Unlike
+// ui.Update, queueing never waits, neither for them to run nor for room
+// in the queue, so it is safe to queue with the lock held or from the
+// UI goroutine itself.
+type updateQueue struct {
+	sync.Mutex
+	fns []func()
+	// wake is signalled when fns is no longer empty.
+	wake chan struct{}
+}
+
+func newUpdateQueue() *updateQueue {
+	return &updateQueue{wake: make(chan struct{}, 1)}
+}
+
+func (q *updateQueue) push(fn func()) {
+	q.Lock()
+	q.fns = append(q.fns, fn)
+	q.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take waits for updates and returns all that are queued.
+func (q *updateQueue) take() []func() {
+	for range q.wake {
+		q.Lock()
+		fns := q.fns
+		q.fns = nil
+		q.Unlock()
+		if len(fns) > 0 {
+			return fns
+		}
+	}
+	return nil
+}
+
+func (s *state) queueUpdate(fn func()) {
+	s.updates.push(fn)
+}
+
+func (s *state) runUpdates(ui tui.UI) {
+	for {
+		for _, fn := range s.updates.take() {
+			ui.Update(fn)
+		}
+	}
+}
+
+// refreshDirect redraws the DM list, keeping the user we show selected.
 // Lock should not be held.
-func (s *state) updateNewMsgState(nkey string, on bool) {
+func (s *state) refreshDirect() {
 	s.Lock()
 	directL := s.direct
 	users := s.userListSorted()
-	selIndex := directL.Selected()
+	var selected *user
+	if s.cur != nil && s.cur.kind == direct {
+		selected = s.dms[s.cur.name]
+	}
+	selIndex := -1
 	directL.OnSelectionChanged(nil)
 	directL.RemoveItems()
 
-	for _, user := range users {
-		name := dName(user)
-		if nkey == user.nkey {
-			if on {
-				if !strings.HasSuffix(name, highlighted) {
-					name = name + highlighted
-					user.nmsgs = true
-				}
-			} else {
-				user.nmsgs = false
-				name = dName(user)
-			}
+	for i, user := range users {
+		if user == selected {
+			selIndex = i
 		}
-		directL.AddItems(name)
+		directL.AddItems(dName(user))
 	}
 	directL.Select(selIndex)
+	if selected != nil {
+		s.cur.index = selIndex
+	}
 	s.Unlock()
 	directL.OnSelectionChanged(s.dmSelChanged)
 }
 
+func (s *state) chSelChanged(l *tui.List) {
+	s.Lock()
+	defer s.Unlock()
+	if s.sameChannel() {
+		if s.cur.index > 0 {
+			s.channels.SetFocused(false)
+			s.direct.SetFocused(true)
+		}
+		return
+	}
+	if s.channels.Selected() >= 0 {
+		s.setPostsDisplay(s.chSel())
+		s.direct.SetSelected(-1)
+	}
+}
+
 func (s *state) dmSelChanged(l *tui.List) {
 	s.Lock()
 	defer s.Unlock()
@@ -176,13 +298,6 @@ func (s *state) dmSelChanged(l *tui.List) {
 	if s.direct.Selected() >= 0 {
 		s.setPostsDisplay(s.dmSel())
 		s.channels.SetSelected(-1)
-		if strings.HasSuffix(s.direct.SelectedItem(), highlighted) {
-			s.Unlock()
-			if u := s.dms[s.cur.name]; u != nil {
-				s.updateNewMsgState(u.nkey, false)
-			}
-			s.Lock()
-		}
 	}
 }
 
@@ -200,17 +315,44 @@ func (s *state) localUserName(p *postClaim) string {
 	return u.name
 }
 
-func (s *state) postEntry(p *postClaim) tui.Widget {
+// Posts from users we could not verify have their name marked.
+const unverified = "?"
+
+// postEntry returns the row for a post, and the label of its message.
+func (s *state) postEntry(p *postClaim, depth int) (tui.Widget, *tui.Label) {
 	t := time.Unix(p.IssuedAt, 0)
 	n := s.localUserName(p)
+	if !s.isVerified(p.Issuer) {
+		n += unverified
+	}
 
-	msgLabel := tui.NewLabel(p.Data["msg"].(string))
+	msg, _ := p.Data["msg"].(string)
+	// Actions from /me read as "* name waves".
+	if action, _ := p.Data["action"].(bool); action {
+		msg, n = n+" "+msg, "*"
+	}
+	if p.sealed {
+		msg = sealedMark + msg
+	}
+	if p.edited != 0 {
+		msg += editedMark
+	}
+	if s.isRead(p) {
+		msg += readMark
+	}
+	msg += s.reactionCounts(p)
+	// Mentions come from all channels.
+	if s.cur.kind == mentions {
+		msg = "[" + p.Subject + "] " + msg
+	}
+	msgLabel := tui.NewLabel(msg)
 	msgLabel.SetWordWrap(true)
+	msgLabel.SetStyleName(s.postStyle(p))
 
 	return tui.NewHBox(
 		tui.NewLabel(t.Format("15:04")),
-		tui.NewPadder(1, 0, tui.NewLabel(postUser(n))),
+		tui.NewPadder(1, 0, tui.NewLabel(threadPrefix(p, depth)+postUser(n))),
 		msgLabel,
 		tui.NewSpacer(),
-	)
+	), msgLabel
 }
@@ -0,0 +1,173 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	jwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+)
+
+// While we have unsent text in the input we say we are typing, at most
+// every typingInterval, with a signed claim that expires shortly
+// after. Channels get it on their typing subject, DMs on the typing
+// subject of the other user. Typing is shown under the messages until
+// it expires, or the user posts.
+
+const (
+	typingInterval = 3 * time.Second
+	typingExpires  = 5 * time.Second
+	typingType     = "chat-typing"
+)
+
+// Where someone is typing, a channel name, or a user's nkey for DMs.
+type typingKey struct {
+	kind pkind
+	name string
+}
+
+// typingIn returns the key of what is on display. Assume lock is held.
+func (s *state) typingIn() typingKey {
+	if s.cur.kind == direct {
+		if u := s.dms[s.cur.name]; u != nil {
+			return typingKey{direct, u.nkey}
+		}
+	}
+	return typingKey{s.cur.kind, s.cur.name}
+}
+
+// inputChanged sends that we are typing, throttled. Commands are not
+// something others wait for. Lock should be held.
+func (s *state) inputChanged(text string) {
+	if text == "" || strings.HasPrefix(text, "/") || s.cur == nil || s.cur.kind == mentions {
+		return
+	}
+	key, now := s.typingIn(), time.Now()
+	if key == s.typingTo && now.Sub(s.typingSent) < typingInterval {
+		return
+	}
+	subj := fmt.Sprintf(typingPub, key.name)
+	if key.kind == direct {
+		if key.name == s.me.Subject {
+			return
+		}
+		subj = fmt.Sprintf(typingDMPub, key.name)
+	}
+
+	tc := jwt.NewGenericClaims(key.name)
+	tc.Name = s.name
+	tc.Expires = now.Add(typingExpires).Unix()
+	tc.Data["type"] = typingType
+	tjwt, err := tc.Encode(s.skp)
+	if err != nil {
+		return
+	}
+	s.typingTo, s.typingSent = key, now
+	s.nc.Publish(subj, []byte(tjwt))
+}
+
+// Receive that someone is typing in a channel, or to us.
+func (s *state) processTyping(m *nats.Msg) {
+	tc := s.checkPostClaim(string(m.Data))
+	if tc == nil || tc.Data["type"] != typingType {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.acceptPost(tc) || tc.Issuer == s.me.Subject {
+		return
+	}
+	// Permissions are checked against the subject, so the claim has to
+	// be for the channel or user it was sent to.
+	key := typingKey{channel, tc.Subject}
+	if m.Subject == fmt.Sprintf(typingDMPub, tc.Subject) {
+		if tc.Subject != s.me.Subject || s.users[tc.Issuer] == nil {
+			return
+		}
+		key = typingKey{direct, tc.Issuer}
+	} else if m.Subject != fmt.Sprintf(typingPub, tc.Subject) || !s.hasChannel(tc.Subject) {
+		return
+	}
+	// Do not trust the sender to keep it short.
+	expires := time.Unix(tc.Expires, 0)
+	if max := time.Now().Add(typingExpires); expires.After(max) {
+		expires = max
+	}
+	if s.typing[key] == nil {
+		s.typing[key] = make(map[string]time.Time)
+	}
+	s.typing[key][tc.Issuer] = expires
+
+	s.queueUpdate(s.showTyping)
+	time.AfterFunc(time.Until(expires)+time.Second/10, func() {
+		s.queueUpdate(s.showTyping)
+	})
+}
+
+// stoppedTyping is called when a user posts, which ends their typing.
+// Assume lock is held.
+func (s *state) stoppedTyping(key typingKey, nkey string) {
+	if _, ok := s.typing[key][nkey]; ok {
+		delete(s.typing[key], nkey)
+		s.queueUpdate(s.showTyping)
+	}
+}
+
+// Runs on the UI goroutine.
+func (s *state) showTyping() {
+	s.Lock()
+	defer s.Unlock()
+	s.drawTyping()
+}
+
+// drawTyping shows who is typing where we are, and forgets those that
+// expired. Assume lock is held.
+func (s *state) drawTyping() {
+	if s.cur == nil || s.typingLabel == nil {
+		return
+	}
+	now := time.Now()
+	for key, who := range s.typing {
+		for nkey, expires := range who {
+			if now.After(expires) {
+				delete(who, nkey)
+			}
+		}
+		if len(who) == 0 {
+			delete(s.typing, key)
+		}
+	}
+
+	var names []string
+	for nkey := range s.typing[s.typingIn()] {
+		if u := s.users[nkey]; u != nil {
+			names = append(names, u.name)
+		}
+	}
+	sort.Strings(names)
+	switch len(names) {
+	case 0:
+		s.typingLabel.SetText("")
+	case 1:
+		s.typingLabel.SetText(" " + names[0] + " is typing…")
+	default:
+		s.typingLabel.SetText(" " + strings.Join(names, ", ") + " are typing…")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+
+	jwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+// Anyone can sign a post with a fresh nkey, so we only trust users
+// whose user JWT, sent with their online status, was issued by our
+// account or one of its signing keys. We learn the signing keys from
+// the deny-list chat-access signs.
+//
+// Posts from users we could not verify are shown with a marker, or
+// dropped with -unverified=drop.
+
+// Assume lock is held.
+func (s *state) trustOwnIssuer() {
+	s.account = s.me.IssuerAccount
+	if s.account == "" {
+		s.account = s.me.Issuer
+	}
+	s.issuers[s.account] = true
+	s.issuers[s.me.Issuer] = true
+	s.verified[s.me.Subject] = true
+	s.moderators[s.me.Subject] = s.me.Tags.Contains(moderatorTag)
+}
+
+// Assume lock is held.
+func (s *state) trustSigningKeys(keys []interface{}) {
+	for _, k := range keys {
+		if sk, ok := k.(string); ok && nkeys.IsValidPublicAccountKey(sk) {
+			s.issuers[sk] = true
+		}
+	}
+}
+
+// verifyUser checks ujwt is a current user JWT for nkey issued by our
+// account. Assume lock is held.
+func (s *state) verifyUser(ujwt, nkey string) (*jwt.UserClaims, error) {
+	uc, err := jwt.DecodeUserClaims(ujwt)
+	if err != nil {
+		return nil, err
+	}
+	vr := jwt.CreateValidationResults()
+	uc.Validate(vr)
+	if vr.IsBlocking(true) {
+		return nil, errors.New("user JWT is not valid")
+	}
+	if uc.Subject != nkey {
+		return nil, errors.New("user JWT is for another user")
+	}
+	if !s.issuers[uc.Issuer] {
+		return nil, errors.New("user JWT was not issued by our account")
+	}
+	if uc.Issuer != s.account && uc.IssuerAccount != s.account {
+		return nil, errors.New("user JWT is for another account")
+	}
+	if s.isRevoked(nkey) {
+		return nil, errors.New("user has been revoked")
+	}
+	return uc, nil
+}
+
+// Assume lock is held.
+func (s *state) isVerified(nkey string) bool {
+	return s.verified[nkey] && !s.isRevoked(nkey)
+}
+
+// acceptPost drops posts from revoked users, and unverified ones if
+// asked to. Assume lock is held.
+func (s *state) acceptPost(p *postClaim) bool {
+	return s.acceptFrom(p.Issuer)
+}
+
+// acceptFrom tells if claims from nkey are taken, the same way posts are.
+// Assume lock is held.
+func (s *state) acceptFrom(nkey string) bool {
+	if s.isRevoked(nkey) {
+		return false
+	}
+	return s.isVerified(nkey) || !s.dropUnverified
+}
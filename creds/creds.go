@@ -0,0 +1,286 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package creds reads and writes NATS credentials files.
+//
+// It understands the decorated files written by nsc and chat-access, bare
+// files holding just the JWT and seed, JWT-only creds for bearer tokens
+// and seed-only nkey files. Secrets are zeroed as soon as we are done
+// with them and problems are returned as errors, never logged.
+package creds
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	jwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+var (
+	// ErrEmpty is returned when there is neither a JWT nor a seed.
+	ErrEmpty = errors.New("no JWT or seed found")
+	// ErrMultiple is returned for more than one JWT or seed.
+	ErrMultiple = errors.New("more than one JWT or seed found")
+	// ErrNoSeed is returned for a JWT without a seed that is not a bearer token.
+	ErrNoSeed = errors.New("seed is missing and JWT is not a bearer token")
+	// ErrNoJWT is returned by LoadUser for seed-only files.
+	ErrNoJWT = errors.New("user JWT is missing")
+	// ErrKeyType is returned for a seed of an unexpected type.
+	ErrKeyType = errors.New("unexpected key type")
+	// ErrKeyMismatch is returned when the seed does not belong to the JWT.
+	ErrKeyMismatch = errors.New("seed does not match the JWT")
+	// ErrExpired is returned for a JWT that has expired.
+	ErrExpired = errors.New("credentials have expired")
+)
+
+// Error tells which file had a problem. Err is one of the errors above
+// or the reason the JWT or seed could not be decoded.
+type Error struct {
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Path == "" {
+		return "creds: " + e.Err.Error()
+	}
+	return fmt.Sprintf("creds: %s: %v", e.Path, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Creds is what we found in a credentials file. JWT and Claims are empty
+// for seed-only files, KeyPair is nil for bearer tokens.
+type Creds struct {
+	JWT     string
+	Claims  *jwt.UserClaims
+	KeyPair nkeys.KeyPair
+}
+
+// PublicKey returns the nkey these creds are for.
+func (c *Creds) PublicKey() string {
+	if c.Claims != nil {
+		return c.Claims.Subject
+	}
+	pub, _ := c.KeyPair.PublicKey()
+	return pub
+}
+
+// Wipe clears the seed held by the key pair.
+func (c *Creds) Wipe() {
+	if c.KeyPair != nil {
+		c.KeyPair.Wipe()
+	}
+}
+
+// Load reads a credentials file, see Parse.
+func Load(path string) (*Creds, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, &Error{path, err}
+	}
+	defer wipe(contents)
+
+	c, err := Parse(contents)
+	if err != nil {
+		err.(*Error).Path = path
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadUser reads creds that can sign as a user, both a JWT and its seed.
+func LoadUser(path string) (*Creds, error) {
+	c, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if c.JWT == "" {
+		c.Wipe()
+		return nil, &Error{path, ErrNoJWT}
+	}
+	if c.KeyPair == nil {
+		return nil, &Error{path, ErrNoSeed}
+	}
+	return c, nil
+}
+
+// LoadSeed reads a seed-only nkey file, such as a signing key, and
+// checks it is one of the expected types, if any are given.
+func LoadSeed(path string, expected ...nkeys.PrefixByte) (nkeys.KeyPair, error) {
+	c, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if c.KeyPair == nil {
+		return nil, &Error{path, ErrEmpty}
+	}
+	if len(expected) > 0 {
+		if err := nkeys.CompatibleKeyPair(c.KeyPair, expected...); err != nil {
+			c.Wipe()
+			return nil, &Error{path, ErrKeyType}
+		}
+	}
+	return c.KeyPair, nil
+}
+
+// Parse finds the user JWT and seed in data. The JWT has to be a user
+// JWT that has not expired, and the seed has to be a user seed for the
+// same nkey. Either can be missing, but a JWT without a seed has to be
+// a bearer token. Parse does not modify data, callers should zero it.
+func Parse(data []byte) (*Creds, error) {
+	var ujwt string
+	var seed []byte
+	defer func() { wipe(seed) }()
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		// Everything else, markers, banners and comments, is skipped.
+		switch {
+		case isJWT(line):
+			if ujwt != "" {
+				return nil, &Error{Err: ErrMultiple}
+			}
+			ujwt = string(line)
+		case isSeed(line):
+			if seed != nil {
+				return nil, &Error{Err: ErrMultiple}
+			}
+			seed = append([]byte(nil), line...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &Error{Err: err}
+	}
+	if ujwt == "" && seed == nil {
+		return nil, &Error{Err: ErrEmpty}
+	}
+
+	c := &Creds{JWT: ujwt}
+	if seed != nil {
+		kp, err := nkeys.FromSeed(seed)
+		if err != nil {
+			return nil, &Error{Err: err}
+		}
+		c.KeyPair = kp
+	}
+	if ujwt == "" {
+		return c, nil
+	}
+
+	uc, err := jwt.DecodeUserClaims(ujwt)
+	if err != nil {
+		c.Wipe()
+		return nil, &Error{Err: err}
+	}
+	c.Claims = uc
+	if uc.Expires > 0 && uc.Expires < time.Now().Unix() {
+		c.Wipe()
+		return nil, &Error{Err: ErrExpired}
+	}
+	if c.KeyPair == nil {
+		if !uc.BearerToken {
+			return nil, &Error{Err: ErrNoSeed}
+		}
+		return c, nil
+	}
+	if err := nkeys.CompatibleKeyPair(c.KeyPair, nkeys.PrefixByteUser); err != nil {
+		c.Wipe()
+		return nil, &Error{Err: ErrKeyType}
+	}
+	if pub, _ := c.KeyPair.PublicKey(); pub != uc.Subject {
+		c.Wipe()
+		return nil, &Error{Err: ErrKeyMismatch}
+	}
+	return c, nil
+}
+
+// JWTs all start with the encoded `{"` of their header.
+func isJWT(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("eyJ")) && bytes.Count(line, []byte(".")) == 2
+}
+
+func isSeed(line []byte) bool {
+	if len(line) == 0 || line[0] != 'S' {
+		return false
+	}
+	_, raw, err := nkeys.DecodeSeed(line)
+	wipe(raw)
+	return err == nil
+}
+
+const credsT = `-----BEGIN NATS USER JWT-----
+%s
+------END NATS USER JWT------
+
+************************* IMPORTANT *************************
+NKEY Seed printed below can be used to sign and prove identity.
+NKEYs are sensitive and should be treated as secrets.
+
+-----BEGIN USER NKEY SEED-----
+%s
+------END USER NKEY SEED------
+
+*************************************************************
+`
+
+// Format returns decorated creds for ujwt and seed, followed by the
+// comments, one per line. Seed can be empty for bearer tokens.
+func Format(ujwt string, seed []byte, comments ...string) []byte {
+	var b bytes.Buffer
+	if len(seed) == 0 {
+		fmt.Fprintf(&b, "-----BEGIN NATS USER JWT-----\n%s\n------END NATS USER JWT------\n", ujwt)
+	} else {
+		fmt.Fprintf(&b, credsT, ujwt, seed)
+	}
+	if len(comments) > 0 {
+		b.WriteString("\n")
+	}
+	for _, c := range comments {
+		b.WriteString("# " + strings.Replace(c, "\n", " ", -1) + "\n")
+	}
+	return b.Bytes()
+}
+
+// Write replaces the creds file at path, by writing a temporary file
+// next to it first, so readers never see a partial file.
+func Write(path, ujwt string, seed []byte, comments ...string) error {
+	contents := Format(ujwt, seed, comments...)
+	defer wipe(contents)
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 'x'
+	}
+}
@@ -0,0 +1,8 @@
+module github.com/connecteverything/oscon2019/creds
+
+go 1.13
+
+require (
+	github.com/nats-io/jwt/v2 v2.0.0-20201015190852-e11ce317263c
+	github.com/nats-io/nkeys v0.4.6
+)